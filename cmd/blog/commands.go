@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command is a subcommand of the blog binary, it returns the exit code
+type command func(args []string) int
+
+// commands contains all subcommands by name
+var commands = map[string]command{
+	"keygen":   keygenCommand,
+	"migrate":  migrateCommand,
+	"reindex":  reindexCommand,
+	"role":     roleCommand,
+	"sanitize": sanitizeCommand,
+}
+
+// runCommand runs the subcommand named by the first argument
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+
+	return cmd(args[1:])
+}
+
+// dbFlag adds the flag for the database file to a flag set
+func dbFlag(fs *flag.FlagSet) *string {
+	return fs.String("db", "goblog.db", "path to the SQLite database")
+}
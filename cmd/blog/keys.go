@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/golangbg/web-api-development-demo/pkg/server"
+)
+
+// keyDir returns the directory with the keys tokens are signed with, from BLOG_JWT_KEYS
+func keyDir() string {
+	if dir := os.Getenv("BLOG_JWT_KEYS"); dir != "" {
+		return dir
+	}
+	return "keys"
+}
+
+// loadKeys loads the keys tokens are signed and verified with
+// A first Ed25519 key is created when there are no keys yet, so the blog runs without any setup
+func loadKeys() (*server.KeyRing, error) {
+	dir := keyDir()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		id, err := server.GenerateKey(dir, server.AlgEdDSA)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("created signing key %s in %s", id, dir)
+	}
+
+	// BLOG_JWT_KEY_ID chooses the key which signs new tokens, so a new key can be published before it's used
+	return server.LoadKeyRing(dir, os.Getenv("BLOG_JWT_KEY_ID"))
+}
+
+// keygenCommand creates a new key for signing tokens, which signs the new tokens after the next restart
+// The old keys keep verifying the tokens they signed until their files are removed
+func keygenCommand(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: blog keygen [-dir keys] [-alg %s|%s|%s]\n", server.AlgEdDSA, server.AlgES256, server.AlgRS256)
+	}
+	dir := fs.String("dir", keyDir(), "directory with the keys, defaults to BLOG_JWT_KEYS")
+	alg := fs.String("alg", server.AlgEdDSA, "algorithm of the new key")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	id, err := server.GenerateKey(*dir, *alg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't create the key: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("created %s key %s in %s\n", *alg, id, *dir)
+	return 0
+}
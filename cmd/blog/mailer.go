@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"github.com/golangbg/web-api-development-demo/pkg/mailer"
+)
+
+// mailerFromEnv configures how the emails of the blog are sent, from the environment:
+// BLOG_SMTP_ADDR sends them through an SMTP server, BLOG_MAIL_DIR writes them to files and otherwise they're logged
+func mailerFromEnv() mailer.Mailer {
+	from := os.Getenv("BLOG_MAIL_FROM")
+	if from == "" {
+		from = "blog@localhost"
+	}
+
+	if addr := os.Getenv("BLOG_SMTP_ADDR"); addr != "" {
+		return mailer.SMTPMailer{
+			Addr:     addr,
+			From:     from,
+			Username: os.Getenv("BLOG_SMTP_USER"),
+			Password: os.Getenv("BLOG_SMTP_PASSWORD"),
+		}
+	}
+
+	if dir := os.Getenv("BLOG_MAIL_DIR"); dir != "" {
+		return mailer.FileMailer{Dir: dir, From: from}
+	}
+
+	return mailer.LogMailer{}
+}
@@ -10,6 +10,11 @@ import (
 )
 
 func main() {
+	// Run a subcommand if one is provided, for example: blog migrate status
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// Get the address for our server from the environment
 	addr := os.Getenv("BLOG_ADDR")
 	if addr == "" {
@@ -17,14 +22,34 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Load the keys the tokens are signed with
+	keys, err := loadKeys()
+	if err != nil {
+		log.Printf("couldn't load the signing keys: %v", err)
+		os.Exit(1)
+	}
+
 	// Create a server instance
-	srv, err := server.New(addr)
+	srv, err := server.New(addr, keys)
 	if err != nil {
 		// Something went wrong
 		log.Printf("couldn't create server: %v", err)
 		os.Exit(1)
 	}
 
+	// Configure how emails are sent and the address used in their links
+	srv.Mailer = mailerFromEnv()
+	if url := os.Getenv("BLOG_URL"); url != "" {
+		srv.BaseURL = url
+	}
+
+	// Trust the X-Forwarded-For header of the reverse proxies the blog runs behind, for the login throttle
+	srv.TrustedProxies, err = server.ParseTrustedProxies(os.Getenv("BLOG_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Printf("invalid BLOG_TRUSTED_PROXIES: %v", err)
+		os.Exit(1)
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
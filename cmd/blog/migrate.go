@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+)
+
+const migrateUsage = `usage: blog migrate [-db goblog.db] <action>
+
+actions:
+  status       show all migrations and whether they have been applied
+  up           apply all pending migrations
+  to <version> migrate up or down to the provided version
+  down         roll back the newest applied migration
+`
+
+// migrateCommand inspects and changes the version of the database schema
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, migrateUsage) }
+	dbName := dbFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	// Open the database without migrating it
+	db, err := database.Open(*dbName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't open database: %v\n", err)
+		return 1
+	}
+	defer db.CloseDB()
+
+	switch fs.Arg(0) {
+	case "status":
+		status, err := db.MigrationStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't get status: %v\n", err)
+			return 1
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.Applied {
+				applied = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-40s %s\n", m.Version, m.Name, applied)
+		}
+		return 0
+	case "up":
+		err = db.MigrateUp()
+	case "to":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return 2
+		}
+		version, convErr := strconv.Atoi(fs.Arg(1))
+		if convErr != nil {
+			fmt.Fprintf(os.Stderr, "invalid version %q\n", fs.Arg(1))
+			return 2
+		}
+		err = db.Migrate(version)
+	case "down":
+		err = db.Rollback()
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration failed: %v\n", err)
+		return 1
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't get version: %v\n", err)
+		return 1
+	}
+	fmt.Printf("database is at version %d\n", version)
+
+	return 0
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+)
+
+// reindexCommand rebuilds the full-text search index from the posts
+func reindexCommand(args []string) int {
+	fs := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, "usage: blog reindex [-db goblog.db]\n") }
+	dbName := dbFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// Open and migrate the database, the search index is created by a migration
+	db, err := database.New(*dbName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't open database: %v\n", err)
+		return 1
+	}
+	defer db.CloseDB()
+
+	if err := db.RebuildSearchIndex(); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't rebuild search index: %v\n", err)
+		return 1
+	}
+	fmt.Println("search index rebuilt")
+
+	return 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// roleCommand changes the role of a user, for example to appoint the first admin
+func roleCommand(args []string) int {
+	fs := flag.NewFlagSet("role", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: blog role [-db goblog.db] <username> <%s>\n", strings.Join(models.Roles, "|"))
+	}
+	dbName := dbFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	username, role := fs.Arg(0), fs.Arg(1)
+	if !models.ValidRole(role) {
+		fmt.Fprintf(os.Stderr, "unknown role %q\n", role)
+		return 2
+	}
+
+	db, err := database.New(*dbName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't open database: %v\n", err)
+		return 1
+	}
+	defer db.CloseDB()
+
+	if err := db.SetUserRole(username, role); err != nil {
+		if err == sql.ErrNoRows {
+			fmt.Fprintf(os.Stderr, "unknown user %q\n", username)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "couldn't change the role: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("%s is now %s\n", username, role)
+	return 0
+}
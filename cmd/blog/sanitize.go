@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+)
+
+// sanitizeCommand runs all existing posts through the sanitization policy again
+func sanitizeCommand(args []string) int {
+	fs := flag.NewFlagSet("sanitize", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, "usage: blog sanitize [-db goblog.db]\n") }
+	dbName := dbFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := database.New(*dbName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't open database: %v\n", err)
+		return 1
+	}
+	defer db.CloseDB()
+
+	changed, err := db.SanitizePosts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't sanitize posts: %v\n", err)
+		return 1
+	}
+
+	for _, slug := range changed {
+		fmt.Printf("sanitized %s\n", slug)
+	}
+	fmt.Printf("%d posts changed\n", len(changed))
+
+	return 0
+}
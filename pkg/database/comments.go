@@ -0,0 +1,135 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// ErrCommentParent is returned by CreateComment when the comment replies to a comment which isn't an approved comment on
+// the same post
+var ErrCommentParent = errors.New("the comment to reply to doesn't exist")
+
+// commentColumns are the columns selected for a comment, in the order scanComment expects them
+// Comments of users show the current name of the user, anonymous comments the name they were written with
+const commentColumns = `comments.id, comments.post_slug, comments.parent_id, comments.user_id,
+	COALESCE(NULLIF(users.name, ''), users.username, comments.name), comments.email, comments.body, comments.created,
+	comments.status, comments.spam_score`
+
+// commentTables joins the comments with their authors
+const commentTables = "comments LEFT JOIN users ON comments.user_id = users.id"
+
+// scanComment scans a row selected with commentColumns into a comment
+func scanComment(row scanner) (models.Comment, error) {
+	c := models.Comment{}
+	var parentID, userID sql.NullInt64
+	if err := row.Scan(&c.ID, &c.Slug, &parentID, &userID, &c.Name, &c.Email, &c.Body, &c.Created,
+		&c.Status, &c.SpamScore); err != nil {
+		return c, err
+	}
+	c.ParentID = parentID.Int64
+	c.UserID = userID.Int64
+
+	return c, nil
+}
+
+// nullID stores 0 as NULL, for optional references to other tables
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// CreateComment adds a comment to a post, comments without a status are pending
+// Returns ErrCommentParent if the comment replies to a comment which isn't an approved comment on the same post
+func (db *DB) CreateComment(comment models.Comment) (models.Comment, error) {
+	comment.Created = time.Now()
+	if comment.Status == "" {
+		comment.Status = models.CommentPending
+	}
+
+	// Replies are only possible to comments which are shown
+	if comment.ParentID != 0 {
+		var slug, status string
+		err := db.conn.QueryRow("SELECT post_slug, status FROM comments WHERE id=?", comment.ParentID).Scan(&slug, &status)
+		if err == sql.ErrNoRows || (err == nil && (slug != comment.Slug || status != models.CommentApproved)) {
+			return comment, ErrCommentParent
+		}
+		if err != nil {
+			return comment, err
+		}
+	}
+
+	q := `INSERT INTO comments(post_slug, parent_id, user_id, name, email, body, created, status, spam_score)
+	values(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.conn.Exec(q, comment.Slug, nullID(comment.ParentID), nullID(comment.UserID),
+		comment.Name, comment.Email, comment.Body, comment.Created, comment.Status, comment.SpamScore)
+	if err != nil {
+		return comment, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return comment, err
+	}
+
+	// Read the comment back, so the name of a user is filled in
+	q = "SELECT " + commentColumns + " FROM " + commentTables + " WHERE comments.id=?"
+	return scanComment(db.conn.QueryRow(q, id))
+}
+
+// GetComments gets the comments on a post with the provided status, oldest first
+// An empty status gets all comments
+func (db *DB) GetComments(slug, status string) (comments []models.Comment, err error) {
+	q := "SELECT " + commentColumns + " FROM " + commentTables + " WHERE comments.post_slug=? AND (?='' OR comments.status=?) ORDER BY comments.id"
+	rows, err := db.conn.Query(q, slug, status, status)
+	if err != nil {
+		return comments, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return comments, err
+		}
+		comments = append(comments, c)
+	}
+
+	return comments, rows.Err()
+}
+
+// SetCommentStatus changes the moderation state of a comment on a post
+// Returns sql.ErrNoRows if the post has no comment with the provided ID
+func (db *DB) SetCommentStatus(slug string, id int64, status string) (models.Comment, error) {
+	res, err := db.conn.Exec("UPDATE comments SET status=? WHERE post_slug=? AND id=?", status, slug, id)
+	if err != nil {
+		return models.Comment{}, err
+	}
+
+	// Check if a comment was actually changed
+	n, err := res.RowsAffected()
+	if err != nil {
+		return models.Comment{}, err
+	}
+	if n == 0 {
+		return models.Comment{}, sql.ErrNoRows
+	}
+
+	q := "SELECT " + commentColumns + " FROM " + commentTables + " WHERE comments.id=?"
+	return scanComment(db.conn.QueryRow(q, id))
+}
+
+// IsApprovedCommenter reports whether a user has had a comment approved before
+func (db *DB) IsApprovedCommenter(userID int64) (approved bool, err error) {
+	q := `SELECT EXISTS(SELECT 1 FROM comments WHERE status='approved' AND user_id=?)`
+	err = db.conn.QueryRow(q, userID).Scan(&approved)
+	return approved, err
+}
+
+// deleteComments removes all comments on a post
+func deleteComments(tx *sql.Tx, slug string) error {
+	_, err := tx.Exec("DELETE FROM comments WHERE post_slug=?", slug)
+	return err
+}
@@ -13,43 +13,18 @@ type DB struct {
 	conn *sql.DB
 }
 
-// InitDB initializes the database
+// InitDB initializes the database by applying all pending migrations
 func (db *DB) InitDB() error {
 	// Check if the server has a database connection
 	if db.conn == nil {
 		return fmt.Errorf("no database is set")
 	}
 
-	// Define the posts table
-	posts := `CREATE TABLE IF NOT EXISTS posts(
-		slug TEXT NOT NULL PRIMARY KEY,
-		user_id INTEGER NOT NULL,
-		title TEXT NOT NULL,
-		body TEXT,
-		created DATETIME,
-		modified DATETIME
-	);`
-
-	// Create the posts table
-	if _, err := db.conn.Exec(posts); err != nil {
-		// Couldn't create the table, return the error
+	if err := db.MigrateUp(); err != nil {
 		return err
 	}
 
-	users := `CREATE TABLE IF NOT EXISTS users(
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT NOT NULL UNIQUE,
-		name TEXT,
-		password TEXT NOT NULL
-	);`
-
-	// Create the users table
-	if _, err := db.conn.Exec(users); err != nil {
-		// Couldn't create the table, return the error
-		return err
-	}
-
-	return nil
+	return db.checkSearchIndex()
 }
 
 // CloseDB closes the database connection
@@ -57,8 +32,9 @@ func (db *DB) CloseDB() error {
 	return db.conn.Close()
 }
 
-// New creates a database connection. Returns a pointer to DB or an error
-func New(name string) (*DB, error) {
+// Open creates a database connection without initializing the database
+// Use it when the schema shouldn't be touched, for example to inspect or roll back migrations
+func Open(name string) (*DB, error) {
 	// Open the database
 	sqlite3, err := sql.Open("sqlite3", name)
 	if err != nil {
@@ -66,12 +42,22 @@ func New(name string) (*DB, error) {
 	}
 
 	// Create a DB instance
-	db := DB{conn: sqlite3}
+	return &DB{conn: sqlite3}, nil
+}
+
+// New creates a database connection and migrates it to the latest version. Returns a pointer to DB or an error
+func New(name string) (*DB, error) {
+	// Open the database
+	db, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
 
 	// Initialize the database
 	if err := db.InitDB(); err != nil {
+		db.CloseDB()
 		return nil, err
 	}
 
-	return &db, nil
+	return db, nil
 }
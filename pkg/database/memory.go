@@ -0,0 +1,1159 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// Memory is a Store which keeps all data in memory
+// It's useful for running the server without a database file, for example when embedding or exercising the handlers
+type Memory struct {
+	// mu guards the maps below, handlers are executed concurrently
+	mu sync.RWMutex
+
+	posts map[string]models.Post
+	// users are keyed by the username in lower case, usernames are unique regardless of case
+	users  map[string]models.User
+	lastID int64
+
+	// revisions contains the revisions per post, oldest first
+	revisions      map[string][]models.Revision
+	lastRevisionID int64
+
+	// redirects maps old slugs to the slugs of the renamed posts
+	redirects map[string]string
+
+	// comments contains the comments per post, oldest first
+	comments      map[string][]models.Comment
+	lastCommentID int64
+
+	// resetTokens maps the hashes of the password reset tokens to the token
+	resetTokens map[string]resetToken
+
+	// totpCounters contains the time step of the last used TOTP code per user ID
+	totpCounters map[int64]int64
+	// recoveryCodes contains the hashes of the unused recovery codes per user ID
+	recoveryCodes map[int64]map[string]bool
+
+	// throttles contains the login throttles, keyed by throttleKey
+	throttles map[string]models.LoginThrottle
+
+	// refreshTokens maps the hashes of the refresh tokens to the token
+	refreshTokens map[string]models.RefreshToken
+	// revokedTokens maps the IDs of the revoked tokens to when they expire
+	revokedTokens map[string]time.Time
+}
+
+// throttleKey returns the key of a login throttle in Memory
+func throttleKey(kind, value string) string {
+	return kind + " " + value
+}
+
+// resetToken is a password reset token kept by Memory
+type resetToken struct {
+	userID  int64
+	expires time.Time
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		posts:     make(map[string]models.Post),
+		users:     make(map[string]models.User),
+		revisions: make(map[string][]models.Revision),
+		redirects: make(map[string]string),
+		comments:  make(map[string][]models.Comment),
+
+		resetTokens: make(map[string]resetToken),
+
+		totpCounters:  make(map[int64]int64),
+		recoveryCodes: make(map[int64]map[string]bool),
+
+		throttles: make(map[string]models.LoginThrottle),
+
+		refreshTokens: make(map[string]models.RefreshToken),
+		revokedTokens: make(map[string]time.Time),
+	}
+}
+
+// author looks up the name of the user with the provided ID
+// The caller must hold the lock
+func (m *Memory) author(id int64) string {
+	for _, u := range m.users {
+		if u.ID == id {
+			return u.Name
+		}
+	}
+	return ""
+}
+
+// CreatePost inserts a new post
+// Returns ErrPostExists if a post with the same slug already exists
+func (m *Memory) CreatePost(post models.Post) (models.Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.posts[post.Slug]; ok {
+		return models.Post{}, ErrPostExists
+	}
+
+	post.Created = time.Now()
+	post.Modified = post.Created
+	post.Tags = models.NormalizeTags(post.Tags)
+	post.UpdateStatus(post.Created)
+	post.Sanitize()
+	m.posts[post.Slug] = post
+	m.addRevision(post)
+	m.deleteRedirects(post.Slug)
+
+	return post, nil
+}
+
+// UpdatePost updates the title, body, tags, publication state and comment settings of the post with the provided slug
+// If post.Slug is another slug the post is renamed to it first, which fails before anything is changed
+// Returns sql.ErrNoRows if there is no post with the provided slug and ErrPostExists if the new slug is taken
+func (m *Memory) UpdatePost(slug string, post models.Post) (models.Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if post.Slug != slug {
+		if err := m.renamePost(slug, post.Slug); err != nil {
+			return models.Post{}, err
+		}
+	}
+
+	existing, ok := m.posts[post.Slug]
+	if !ok {
+		return models.Post{}, sql.ErrNoRows
+	}
+
+	post.Sanitize()
+	existing.Title = post.Title
+	existing.Body = post.Body
+	existing.Markdown = post.Markdown
+	existing.Tags = models.NormalizeTags(post.Tags)
+	existing.Modified = time.Now()
+	existing.Status = post.Status
+	existing.PublishAt = post.PublishAt
+	existing.AutoApproveComments = post.AutoApproveComments
+	existing.UpdateStatus(existing.Modified)
+	m.posts[post.Slug] = existing
+	m.addRevision(existing)
+
+	post.Tags = existing.Tags
+	post.Modified = existing.Modified
+	post.Status = existing.Status
+	post.PublishAt = existing.PublishAt
+	return post, nil
+}
+
+// addRevision stores the current content of a post as a new revision
+// The caller must hold the lock
+func (m *Memory) addRevision(post models.Post) {
+	m.lastRevisionID++
+	rev := models.NewRevision(post)
+	rev.ID = m.lastRevisionID
+	m.revisions[post.Slug] = append(m.revisions[post.Slug], rev)
+}
+
+// GetRevisions gets all revisions of a post, newest first
+func (m *Memory) GetRevisions(slug string) ([]models.Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revisions := []models.Revision{}
+	for i := len(m.revisions[slug]) - 1; i >= 0; i-- {
+		rev := m.revisions[slug][i]
+		rev.Author = m.author(rev.UserID)
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, nil
+}
+
+// GetRevision gets a single revision of a post
+// Returns sql.ErrNoRows if the post has no revision with the provided ID
+func (m *Memory) GetRevision(slug string, id int64) (models.Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, rev := range m.revisions[slug] {
+		if rev.ID == id {
+			rev.Author = m.author(rev.UserID)
+			return rev, nil
+		}
+	}
+
+	return models.Revision{}, sql.ErrNoRows
+}
+
+// CreateComment adds a comment to a post, comments without a status are pending
+// Returns ErrCommentParent if the comment replies to a comment which isn't an approved comment on the same post
+func (m *Memory) CreateComment(comment models.Comment) (models.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if comment.ParentID != 0 {
+		found := false
+		for _, c := range m.comments[comment.Slug] {
+			if c.ID == comment.ParentID && c.Status == models.CommentApproved {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return comment, ErrCommentParent
+		}
+	}
+
+	m.lastCommentID++
+	comment.ID = m.lastCommentID
+	comment.Created = time.Now()
+	if comment.Status == "" {
+		comment.Status = models.CommentPending
+	}
+	m.comments[comment.Slug] = append(m.comments[comment.Slug], comment)
+
+	comment.Name = m.commenter(comment)
+	return comment, nil
+}
+
+// GetComments gets the comments on a post with the provided status, oldest first
+// An empty status gets all comments
+func (m *Memory) GetComments(slug, status string) ([]models.Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	comments := []models.Comment{}
+	for _, c := range m.comments[slug] {
+		if status != "" && c.Status != status {
+			continue
+		}
+		c.Name = m.commenter(c)
+		comments = append(comments, c)
+	}
+
+	return comments, nil
+}
+
+// SetCommentStatus changes the moderation state of a comment on a post
+// Returns sql.ErrNoRows if the post has no comment with the provided ID
+func (m *Memory) SetCommentStatus(slug string, id int64, status string) (models.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, c := range m.comments[slug] {
+		if c.ID == id {
+			c.Status = status
+			m.comments[slug][i] = c
+			c.Name = m.commenter(c)
+			return c, nil
+		}
+	}
+
+	return models.Comment{}, sql.ErrNoRows
+}
+
+// IsApprovedCommenter reports whether a user has had a comment approved before
+func (m *Memory) IsApprovedCommenter(userID int64) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, comments := range m.comments {
+		for _, c := range comments {
+			if c.Status == models.CommentApproved && c.UserID == userID {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// commenter returns the name shown for a comment, the current name of the user or the name of an anonymous commenter
+// The caller must hold the lock
+func (m *Memory) commenter(c models.Comment) string {
+	if c.UserID == 0 {
+		return c.Name
+	}
+	for _, u := range m.users {
+		if u.ID == c.UserID {
+			if u.Name != "" {
+				return u.Name
+			}
+			return u.Username
+		}
+	}
+	return c.Name
+}
+
+// DeletePost deletes a post by it's slug
+// Returns sql.ErrNoRows if there is no post with the provided slug
+func (m *Memory) DeletePost(slug string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.posts[slug]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.posts, slug)
+	delete(m.revisions, slug)
+	delete(m.comments, slug)
+	m.deleteRedirects(slug)
+
+	return nil
+}
+
+// AvailableSlug returns the first slug based on base which isn't reserved, used by a post or redirected
+func (m *Memory) AvailableSlug(base string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for n := 1; n <= maxSlugCandidates; n++ {
+		slug := models.SlugCandidate(base, n)
+		if models.IsReservedSlug(slug) {
+			continue
+		}
+		if _, ok := m.posts[slug]; ok {
+			continue
+		}
+		if _, ok := m.redirects[slug]; ok {
+			continue
+		}
+		return slug, nil
+	}
+
+	return "", fmt.Errorf("no slug available for %q", base)
+}
+
+// renamePost changes the slug of a post and leaves a redirect from the old slug to the new one
+// The caller must hold the lock
+// Returns ErrPostExists if the new slug is taken and sql.ErrNoRows if there is no post with the old slug
+func (m *Memory) renamePost(oldSlug, newSlug string) error {
+	post, ok := m.posts[oldSlug]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if _, ok := m.posts[newSlug]; ok {
+		return ErrPostExists
+	}
+
+	post.Slug = newSlug
+	m.posts[newSlug] = post
+	delete(m.posts, oldSlug)
+
+	revisions := m.revisions[oldSlug]
+	for i := range revisions {
+		revisions[i].Slug = newSlug
+	}
+	m.revisions[newSlug] = revisions
+	delete(m.revisions, oldSlug)
+
+	comments := m.comments[oldSlug]
+	for i := range comments {
+		comments[i].Slug = newSlug
+	}
+	m.comments[newSlug] = comments
+	delete(m.comments, oldSlug)
+
+	// Point the existing redirects at the new slug, so redirects are never chained
+	delete(m.redirects, newSlug)
+	for from, to := range m.redirects {
+		if to == oldSlug {
+			m.redirects[from] = newSlug
+		}
+	}
+	m.redirects[oldSlug] = newSlug
+
+	return nil
+}
+
+// GetSlugRedirect returns the slug an old slug redirects to
+// Returns sql.ErrNoRows if there is no redirect for the slug
+func (m *Memory) GetSlugRedirect(slug string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	newSlug, ok := m.redirects[slug]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return newSlug, nil
+}
+
+// deleteRedirects removes the redirects from and to a slug
+// The caller must hold the lock
+func (m *Memory) deleteRedirects(slug string) {
+	delete(m.redirects, slug)
+	for from, to := range m.redirects {
+		if to == slug {
+			delete(m.redirects, from)
+		}
+	}
+}
+
+// GetPostBySlug gets a post by it's slug
+// Unpublished posts are only returned to their author and to models.ViewAll
+func (m *Memory) GetPostBySlug(slug string, viewer int64) (models.Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	post, ok := m.posts[slug]
+	if !ok || !post.VisibleTo(viewer) {
+		return models.Post{}, sql.ErrNoRows
+	}
+	post.Author = m.author(post.UserID)
+
+	return post, nil
+}
+
+// GetAllPosts gets all posts, newest first
+// Unpublished posts are only returned to their author and to models.ViewAll
+func (m *Memory) GetAllPosts(viewer int64) (posts []models.Post, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, post := range m.posts {
+		if !post.VisibleTo(viewer) {
+			continue
+		}
+		post.Author = m.author(post.UserID)
+		posts = append(posts, post)
+	}
+
+	// Sort the posts the same way the SQLite implementation does
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].Created.After(posts[j].Created)
+	})
+
+	return posts, nil
+}
+
+// GetPosts gets a single page of posts
+func (m *Memory) GetPosts(query PostQuery) (page PostPage, err error) {
+	if _, ok := sortColumns[query.Sort.Field]; !ok {
+		return page, fmt.Errorf("invalid sort %q", query.Sort.Field)
+	}
+	if query.Limit <= 0 {
+		return page, fmt.Errorf("invalid limit %d", query.Limit)
+	}
+
+	var after *cursor
+	if query.Cursor != "" {
+		c, err := decodeCursor(query.Sort, query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		after = &c
+	}
+
+	// less reports whether a sorts before b, the slug breaks ties like in the SQLite implementation
+	less := func(aKey, aSlug, bKey, bSlug string) bool {
+		if aKey != bKey {
+			return (aKey < bKey) != query.Sort.Desc
+		}
+		return (aSlug < bSlug) != query.Sort.Desc
+	}
+
+	posts, _ := m.GetAllPosts(query.Filter.Viewer)
+	sort.Slice(posts, func(i, j int) bool {
+		return less(query.Sort.key(posts[i]), posts[i].Slug, query.Sort.key(posts[j]), posts[j].Slug)
+	})
+
+	for _, post := range posts {
+		if !query.Filter.match(post) {
+			continue
+		}
+
+		// Skip everything up to and including the cursor
+		if after != nil && !less(after.Key, after.Slug, query.Sort.key(post), post.Slug) {
+			continue
+		}
+		page.Posts = append(page.Posts, post)
+
+		if len(page.Posts) > query.Limit {
+			page.Posts = page.Posts[:query.Limit]
+			last := page.Posts[len(page.Posts)-1]
+			page.NextCursor = encodeCursor(query.Sort, query.Sort.key(last), last.Slug)
+			break
+		}
+	}
+
+	return page, nil
+}
+
+// GetPostsByPage gets a numbered page of posts, newest first
+func (m *Memory) GetPostsByPage(filter PostFilter, page, perPage int) (posts []models.Post, err error) {
+	if page < 1 || perPage < 1 {
+		return posts, fmt.Errorf("invalid page %d", page)
+	}
+
+	all, _ := m.GetAllPosts(filter.Viewer)
+	for _, post := range all {
+		if filter.match(post) {
+			posts = append(posts, post)
+		}
+	}
+
+	// Cut the requested page out of the filtered posts
+	start := (page - 1) * perPage
+	if start >= len(posts) {
+		return nil, nil
+	}
+	end := start + perPage
+	if end > len(posts) {
+		end = len(posts)
+	}
+
+	return posts[start:end], nil
+}
+
+// CountPosts counts the posts which pass the filter
+func (m *Memory) CountPosts(filter PostFilter) (count int, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, post := range m.posts {
+		if filter.match(post) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// PublishDuePosts publishes the scheduled posts whose PublishAt has passed
+// Returns the slugs of the published posts
+func (m *Memory) PublishDuePosts(now time.Time) (published []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for slug, post := range m.posts {
+		if post.Status == models.StatusScheduled && !post.PublishAt.After(now) {
+			post.Status = models.StatusPublished
+			m.posts[slug] = post
+			published = append(published, slug)
+		}
+	}
+
+	return published, nil
+}
+
+// GetArchive gets the number of published posts per month, newest month first
+func (m *Memory) GetArchive() (archive []models.ArchiveMonth, err error) {
+	all, _ := m.GetAllPosts(0)
+
+	// The posts are sorted newest first, so the months are as well
+	for _, post := range all {
+		created := post.Created.UTC()
+		if n := len(archive); n > 0 && archive[n-1].Year == created.Year() && archive[n-1].Month == created.Month() {
+			archive[n-1].Count++
+			continue
+		}
+		archive = append(archive, models.ArchiveMonth{Year: created.Year(), Month: created.Month(), Count: 1})
+	}
+
+	return archive, nil
+}
+
+// GetTags gets all tags with the number of published posts using them, ordered by name
+// Tags only exist as long as a published post uses them
+func (m *Memory) GetTags() (tags []models.Tag, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, post := range m.posts {
+		if !post.Published() {
+			continue
+		}
+		for _, tag := range post.Tags {
+			counts[tag]++
+		}
+	}
+
+	for name, count := range counts {
+		tags = append(tags, models.Tag{Name: name, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags, nil
+}
+
+// SearchPosts searches the title and body of all published posts, the best matches come first
+// Unlike the SQLite implementation it matches substrings, without stemming or diacritics removal
+func (m *Memory) SearchPosts(query string, limit, offset int) (results []models.SearchResult, err error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return results, fmt.Errorf("empty query")
+	}
+	if limit <= 0 || offset < 0 {
+		return results, fmt.Errorf("invalid limit %d", limit)
+	}
+
+	posts, _ := m.GetAllPosts(0)
+	for _, post := range posts {
+		title := strings.ToLower(post.Title)
+		text := post.PlainText()
+		body := strings.ToLower(text)
+
+		// All terms must match, matches in the title weigh heavier like in the SQLite implementation
+		rank := 0.0
+		for _, term := range terms {
+			t, b := strings.Count(title, term), strings.Count(body, term)
+			if t+b == 0 {
+				rank = 0
+				break
+			}
+			rank -= 10*float64(t) + float64(b)
+		}
+		if rank == 0 {
+			continue
+		}
+
+		results = append(results, models.SearchResult{Post: post, Snippet: memorySnippet(text, terms), Rank: rank})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Rank < results[j].Rank
+	})
+
+	// Cut the requested page out of the results
+	if offset >= len(results) {
+		return nil, nil
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// memorySnippet returns the words around the first match, with the matching words highlighted
+func memorySnippet(text string, terms []string) template.HTML {
+	words := strings.Fields(text)
+
+	matches := func(word string) bool {
+		for _, term := range terms {
+			if strings.Contains(strings.ToLower(word), term) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Start a few words before the first match
+	start := 0
+	for i, word := range words {
+		if matches(word) {
+			start = i - snippetTokens/3
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetTokens
+	if end > len(words) {
+		end = len(words)
+	}
+
+	snippet := []string{}
+	if start > 0 {
+		snippet = append(snippet, "…")
+	}
+	for _, word := range words[start:end] {
+		if matches(word) {
+			word = models.SnippetMatchStart + word + models.SnippetMatchEnd
+		}
+		snippet = append(snippet, word)
+	}
+	if end < len(words) {
+		snippet = append(snippet, "…")
+	}
+
+	return models.HighlightSnippet(strings.Join(snippet, " "))
+}
+
+// CreateUser adds a new user, the password is hashed if it isn't empty
+// Returns ErrUserExists if the username is taken, an existing user is never overwritten
+func (m *Memory) CreateUser(user models.User, password string) (models.User, error) {
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return user, err
+		}
+		user.Password = hash
+	}
+	if user.Role == "" {
+		user.Role = models.DefaultRole
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := strings.ToLower(user.Username)
+	if _, ok := m.users[key]; ok {
+		return models.User{}, ErrUserExists
+	}
+
+	m.lastID++
+	user.ID = m.lastID
+	m.users[key] = user
+
+	return user, nil
+}
+
+// GetUserByID gets a user by its ID, returns sql.ErrNoRows if the user doesn't exist
+func (m *Memory) GetUserByID(id int64) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// GetUserByUsername gets a user by the username, regardless of case
+func (m *Memory) GetUserByUsername(username string) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[strings.ToLower(username)]
+	if !ok {
+		return models.User{}, sql.ErrNoRows
+	}
+
+	return user, nil
+}
+
+// GetUsers gets all users, ordered by username
+func (m *Memory) GetUsers() ([]models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]models.User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	return users, nil
+}
+
+// GetUsersByEmail gets the users with an email address regardless of case, ordered by username
+func (m *Memory) GetUsersByEmail(email string) ([]models.User, error) {
+	users, _ := m.GetUsers()
+
+	matching := []models.User{}
+	for _, u := range users {
+		if email != "" && strings.EqualFold(u.Email, email) {
+			matching = append(matching, u)
+		}
+	}
+
+	return matching, nil
+}
+
+// CreatePasswordResetToken stores the hash of a new password reset token for a user, valid until expires
+// Older tokens of the user and expired tokens are removed
+func (m *Memory) CreatePasswordResetToken(userID int64, tokenHash string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for hash, t := range m.resetTokens {
+		if t.userID == userID || !t.expires.After(now) {
+			delete(m.resetTokens, hash)
+		}
+	}
+	m.resetTokens[tokenHash] = resetToken{userID: userID, expires: expires}
+
+	return nil
+}
+
+// GetPasswordResetUser gets the user a password reset token was issued for, without using the token
+// Returns sql.ErrNoRows if the token doesn't exist or has expired
+func (m *Memory) GetPasswordResetUser(tokenHash string, now time.Time) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.resetUser(tokenHash, now)
+}
+
+// resetUser looks up the user of a password reset token which hasn't expired
+// The caller must hold the lock
+func (m *Memory) resetUser(tokenHash string, now time.Time) (models.User, error) {
+	t, ok := m.resetTokens[tokenHash]
+	if !ok || !t.expires.After(now) {
+		return models.User{}, sql.ErrNoRows
+	}
+	for _, u := range m.users {
+		if u.ID == t.userID {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// UsePasswordResetToken uses up a password reset token and returns the user it was issued for
+// All tokens of the user are removed. Returns sql.ErrNoRows if the token doesn't exist, has expired or has been used
+func (m *Memory) UsePasswordResetToken(tokenHash string, now time.Time) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.resetUser(tokenHash, now)
+	if err != nil {
+		return user, err
+	}
+	for hash, t := range m.resetTokens {
+		if t.userID == user.ID {
+			delete(m.resetTokens, hash)
+		}
+	}
+
+	return user, nil
+}
+
+// UpdateUser updates the name, email address, role and account state of an existing user, the user is found by its ID
+// The password is replaced if a new one is provided, which ends a forced password reset. The username never changes
+// Returns sql.ErrNoRows if the user doesn't exist
+func (m *Memory) UpdateUser(user models.User, password string) (models.User, error) {
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return user, err
+		}
+		user.Password = hash
+		user.PasswordReset = false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for username, u := range m.users {
+		if u.ID == user.ID {
+			u.Name, u.Email, u.EmailVerified, u.Password, u.Role = user.Name, user.Email, user.EmailVerified, user.Password, user.Role
+			u.Disabled, u.PasswordReset = user.Disabled, user.PasswordReset
+			m.users[username] = u
+			if password != "" {
+				m.deleteRefreshTokens(user.ID)
+			}
+			return u, nil
+		}
+	}
+
+	return user, sql.ErrNoRows
+}
+
+// DeleteUser deletes a user, returns ErrUserHasPosts if the user still has posts
+// The comments of the user are kept as anonymous comments under the username
+// Returns sql.ErrNoRows if there is no user with the provided username
+func (m *Memory) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[strings.ToLower(username)]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	for _, p := range m.posts {
+		if p.UserID == user.ID {
+			return ErrUserHasPosts
+		}
+	}
+
+	for slug, comments := range m.comments {
+		for i, c := range comments {
+			if c.UserID == user.ID {
+				comments[i].UserID = 0
+				comments[i].Name = user.Username
+			}
+		}
+		m.comments[slug] = comments
+	}
+	for hash, t := range m.resetTokens {
+		if t.userID == user.ID {
+			delete(m.resetTokens, hash)
+		}
+	}
+	delete(m.totpCounters, user.ID)
+	delete(m.recoveryCodes, user.ID)
+	m.deleteRefreshTokens(user.ID)
+	delete(m.users, strings.ToLower(username))
+
+	return nil
+}
+
+// SetUserTOTP stores the TOTP secret of a user and whether two-factor authentication is enabled
+// Returns sql.ErrNoRows if the user doesn't exist
+func (m *Memory) SetUserTOTP(userID int64, secret string, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for username, u := range m.users {
+		if u.ID == userID {
+			u.TOTPSecret, u.TOTPEnabled = secret, enabled
+			m.users[username] = u
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+// UseTOTPCounter records that the TOTP code of a time step was used by a user
+// Returns ErrTOTPCodeUsed if a code of the same or a later time step was used before
+func (m *Memory) UseTOTPCounter(userID int64, counter int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if counter <= m.totpCounters[userID] {
+		return ErrTOTPCodeUsed
+	}
+	m.totpCounters[userID] = counter
+
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user with the provided hashes
+func (m *Memory) ReplaceRecoveryCodes(userID int64, codeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := make(map[string]bool)
+	for _, hash := range codeHashes {
+		codes[hash] = true
+	}
+	m.recoveryCodes[userID] = codes
+
+	return nil
+}
+
+// UseRecoveryCode uses up a recovery code of a user
+// Returns sql.ErrNoRows if the user has no recovery code with the hash
+func (m *Memory) UseRecoveryCode(userID int64, codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.recoveryCodes[userID][codeHash] {
+		return sql.ErrNoRows
+	}
+	delete(m.recoveryCodes[userID], codeHash)
+
+	return nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (m *Memory) CountRecoveryCodes(userID int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.recoveryCodes[userID]), nil
+}
+
+// GetLoginThrottle gets the login throttle of a username or an IP address
+// Returns sql.ErrNoRows if there were no failed logins for it
+func (m *Memory) GetLoginThrottle(kind, value string) (models.LoginThrottle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.throttles[throttleKey(kind, value)]
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+// GetLoginThrottles gets the login throttles which had a failed login since the provided time, or which are still
+// locked out at it, the most recent failures first
+func (m *Memory) GetLoginThrottles(since time.Time) ([]models.LoginThrottle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	throttles := []models.LoginThrottle{}
+	for _, t := range m.throttles {
+		if t.LastFailure.After(since) || t.Locked(since) {
+			throttles = append(throttles, t)
+		}
+	}
+	sort.Slice(throttles, func(i, j int) bool {
+		return throttles[i].LastFailure.After(throttles[j].LastFailure)
+	})
+
+	return throttles, nil
+}
+
+// RecordLoginFailure counts a failed login for a username or an IP address at now, and returns the updated throttle
+// Failures from before resetBefore are forgotten, the count starts over
+func (m *Memory) RecordLoginFailure(kind, value string, now, resetBefore time.Time) (models.LoginThrottle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, t := range m.throttles {
+		if !t.LastFailure.After(resetBefore) && !t.Locked(now) {
+			delete(m.throttles, key)
+		}
+	}
+
+	key := throttleKey(kind, value)
+	t, ok := m.throttles[key]
+	if !ok {
+		t = models.LoginThrottle{Kind: kind, Value: value}
+	}
+	t.Failures++
+	t.LastFailure = now
+	m.throttles[key] = t
+
+	return t, nil
+}
+
+// LockLogins locks out the logins of a username or an IP address until the provided time
+// Returns sql.ErrNoRows if there were no failed logins for it
+func (m *Memory) LockLogins(kind, value string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := throttleKey(kind, value)
+	t, ok := m.throttles[key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	t.LockedUntil = until
+	m.throttles[key] = t
+
+	return nil
+}
+
+// ClearLoginThrottle forgets the failed logins of a username or an IP address and lifts its lockout
+// Returns sql.ErrNoRows if there were no failed logins for it
+func (m *Memory) ClearLoginThrottle(kind, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := throttleKey(kind, value)
+	if _, ok := m.throttles[key]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.throttles, key)
+
+	return nil
+}
+
+// SetUserRole changes the role of a user
+// Returns sql.ErrNoRows if there is no user with the provided username
+func (m *Memory) SetUserRole(username, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[strings.ToLower(username)]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.Role = role
+	m.users[strings.ToLower(username)] = user
+
+	return nil
+}
+
+// CloseDB is a no-op, there is nothing to release
+func (m *Memory) CloseDB() error {
+	return nil
+}
+
+// deleteRefreshTokens deletes all refresh tokens of a user
+// The caller must hold the lock
+func (m *Memory) deleteRefreshTokens(userID int64) {
+	for hash, t := range m.refreshTokens {
+		if t.UserID == userID {
+			delete(m.refreshTokens, hash)
+		}
+	}
+}
+
+// CreateRefreshToken stores the hash of a new refresh token, expired tokens are removed
+func (m *Memory) CreateRefreshToken(t models.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, rt := range m.refreshTokens {
+		if !rt.Expires.After(t.Created) {
+			delete(m.refreshTokens, hash)
+		}
+	}
+	m.refreshTokens[t.TokenHash] = t
+
+	return nil
+}
+
+// UseRefreshToken marks a refresh token as used and returns it, so it can't be exchanged again
+// Returns sql.ErrNoRows if the token doesn't exist or has expired, and ErrRefreshTokenUsed together with the token if
+// it was used already
+func (m *Memory) UseRefreshToken(tokenHash string, now time.Time) (models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.refreshTokens[tokenHash]
+	if !ok || !t.Expires.After(now) {
+		return models.RefreshToken{}, sql.ErrNoRows
+	}
+	if t.Used {
+		return t, ErrRefreshTokenUsed
+	}
+	t.Used = true
+	m.refreshTokens[tokenHash] = t
+
+	return t, nil
+}
+
+// RevokeRefreshTokens deletes all refresh tokens of a family
+func (m *Memory) RevokeRefreshTokens(family string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, t := range m.refreshTokens {
+		if t.Family == family {
+			delete(m.refreshTokens, hash)
+		}
+	}
+
+	return nil
+}
+
+// RevokeToken adds the ID of a token to the revocation list until it expires, expired tokens are removed
+func (m *Memory) RevokeToken(id string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for revoked, exp := range m.revokedTokens {
+		if !exp.After(now) {
+			delete(m.revokedTokens, revoked)
+		}
+	}
+	m.revokedTokens[id] = expires
+
+	return nil
+}
+
+// IsTokenRevoked reports whether the ID of a token is on the revocation list
+func (m *Memory) IsTokenRevoked(id string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.revokedTokens[id]
+	return ok, nil
+}
@@ -0,0 +1,436 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Migration is a single, numbered change to the database schema
+// Up applies the change, Down reverts it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// UpFunc is optional and runs after Up in the same transaction, for changes which can't be expressed in SQL
+	UpFunc func(tx *sql.Tx) error
+}
+
+// migrations contains all schema changes, ordered by version
+// Never change a migration which has been released, add a new one instead
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create posts table",
+		// IF NOT EXISTS allows databases created before migrations existed to be adopted
+		Up: `CREATE TABLE IF NOT EXISTS posts(
+			slug TEXT NOT NULL PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			body TEXT,
+			created DATETIME,
+			modified DATETIME
+		);`,
+		Down: `DROP TABLE posts;`,
+	},
+	{
+		Version: 2,
+		Name:    "create users table",
+		Up: `CREATE TABLE IF NOT EXISTS users(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			name TEXT,
+			password TEXT NOT NULL
+		);`,
+		Down: `DROP TABLE users;`,
+	},
+	{
+		Version: 3,
+		Name:    "create tags tables",
+		Up: `CREATE TABLE tags(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE
+		);
+		CREATE TABLE post_tags(
+			post_slug TEXT NOT NULL,
+			tag_id INTEGER NOT NULL,
+			PRIMARY KEY(post_slug, tag_id)
+		);
+		CREATE INDEX post_tags_tag_id ON post_tags(tag_id);`,
+		Down: `DROP TABLE post_tags;
+		DROP TABLE tags;`,
+	},
+	{
+		Version: 4,
+		Name:    "create full-text search index",
+		// Needs SQLite with FTS5, without it the index is skipped and search is unavailable, see the README
+		UpFunc: createSearchIndex,
+		Down:   `DROP TABLE IF EXISTS posts_fts;`,
+	},
+	{
+		Version: 5,
+		Name:    "add markdown source to posts",
+		Up:      `ALTER TABLE posts ADD COLUMN markdown TEXT NOT NULL DEFAULT '';`,
+		Down:    `ALTER TABLE posts DROP COLUMN markdown;`,
+	},
+	{
+		Version: 6,
+		Name:    "create post revisions table",
+		// The current content of every existing post becomes its first revision
+		Up: `CREATE TABLE post_revisions(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			post_slug TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			body TEXT NOT NULL DEFAULT '',
+			markdown TEXT NOT NULL DEFAULT '',
+			tags TEXT NOT NULL DEFAULT '',
+			created DATETIME NOT NULL
+		);
+		CREATE INDEX post_revisions_post_slug ON post_revisions(post_slug);
+		INSERT INTO post_revisions(post_slug, user_id, title, body, markdown, tags, created)
+		SELECT slug, user_id, title, COALESCE(body, ''), markdown,
+			COALESCE((SELECT GROUP_CONCAT(tags.name) FROM post_tags JOIN tags ON tags.id = post_tags.tag_id WHERE post_tags.post_slug = posts.slug), ''),
+			COALESCE(modified, created)
+		FROM posts;`,
+		Down: `DROP TABLE post_revisions;`,
+	},
+	{
+		Version: 7,
+		Name:    "add publication state to posts",
+		// Existing posts were visible to everybody, so they are published as of their creation
+		Up: `ALTER TABLE posts ADD COLUMN status TEXT NOT NULL DEFAULT 'published';
+		ALTER TABLE posts ADD COLUMN publish_at DATETIME;
+		UPDATE posts SET publish_at = created;
+		CREATE INDEX posts_status_publish_at ON posts(status, publish_at);`,
+		Down: `DROP INDEX posts_status_publish_at;
+		ALTER TABLE posts DROP COLUMN publish_at;
+		ALTER TABLE posts DROP COLUMN status;`,
+	},
+	{
+		Version: 8,
+		Name:    "create slug redirects table",
+		Up: `CREATE TABLE slug_redirects(
+			old_slug TEXT NOT NULL PRIMARY KEY,
+			new_slug TEXT NOT NULL,
+			created DATETIME NOT NULL
+		);
+		CREATE INDEX slug_redirects_new_slug ON slug_redirects(new_slug);`,
+		Down: `DROP TABLE slug_redirects;`,
+	},
+	{
+		Version: 9,
+		Name:    "create comments table",
+		// parent_id is NULL for top level comments, user_id is NULL for anonymous comments
+		Up: `CREATE TABLE comments(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			post_slug TEXT NOT NULL,
+			parent_id INTEGER REFERENCES comments(id),
+			user_id INTEGER REFERENCES users(id),
+			name TEXT NOT NULL DEFAULT '',
+			email TEXT NOT NULL DEFAULT '',
+			body TEXT NOT NULL,
+			created DATETIME NOT NULL
+		);
+		CREATE INDEX comments_post_slug ON comments(post_slug);`,
+		Down: `DROP TABLE comments;`,
+	},
+	{
+		Version: 10,
+		Name:    "add comment moderation",
+		// Existing comments were shown to everybody, so they are approved
+		Up: `ALTER TABLE comments ADD COLUMN status TEXT NOT NULL DEFAULT 'approved';
+		ALTER TABLE comments ADD COLUMN spam_score REAL NOT NULL DEFAULT 0;
+		CREATE INDEX comments_status ON comments(status);
+		ALTER TABLE posts ADD COLUMN auto_approve_comments INTEGER NOT NULL DEFAULT 0;`,
+		Down: `ALTER TABLE posts DROP COLUMN auto_approve_comments;
+		DROP INDEX comments_status;
+		ALTER TABLE comments DROP COLUMN spam_score;
+		ALTER TABLE comments DROP COLUMN status;`,
+	},
+	{
+		Version: 11,
+		Name:    "add roles to users",
+		// Existing users could write posts, so they become authors. Use blog role to appoint admins and editors
+		Up:   `ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'author';`,
+		Down: `ALTER TABLE users DROP COLUMN role;`,
+	},
+	{
+		Version: 12,
+		Name:    "add account states to users",
+		Up: `ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE users ADD COLUMN password_reset INTEGER NOT NULL DEFAULT 0;`,
+		Down: `ALTER TABLE users DROP COLUMN password_reset;
+		ALTER TABLE users DROP COLUMN disabled;`,
+	},
+	{
+		Version: 13,
+		Name:    "make usernames unique regardless of case",
+		// Fails if there are usernames which only differ in case, one of those accounts has to be deleted first
+		Up:   `CREATE UNIQUE INDEX users_username_nocase ON users(username COLLATE NOCASE);`,
+		Down: `DROP INDEX users_username_nocase;`,
+	},
+	{
+		Version: 14,
+		Name:    "add emails and password reset tokens",
+		// Only hashes of the tokens are stored, the tokens themselves are only sent to the user
+		Up: `ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+		CREATE TABLE password_reset_tokens(
+			token_hash TEXT NOT NULL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			created DATETIME NOT NULL,
+			expires DATETIME NOT NULL
+		);
+		CREATE INDEX password_reset_tokens_user ON password_reset_tokens(user_id);`,
+		Down: `DROP TABLE password_reset_tokens;
+		ALTER TABLE users DROP COLUMN email;`,
+	},
+	{
+		Version: 15,
+		Name:    "add email verification",
+		// The users from before email verification existed keep publishing, they are considered verified even though they
+		// have no email address yet. Once they enter one, they have to verify it
+		Up: `ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+		UPDATE users SET email_verified=1;`,
+		Down: `ALTER TABLE users DROP COLUMN email_verified;`,
+	},
+	{
+		Version: 16,
+		Name:    "add two-factor authentication",
+		// The TOTP secret has to be stored as it is to check the codes, the recovery codes are only stored hashed.
+		// totp_counter is the time step of the last used code, so every code can only be used once
+		Up: `ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE users ADD COLUMN totp_counter INTEGER NOT NULL DEFAULT 0;
+		CREATE TABLE recovery_codes(
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY(user_id, code_hash)
+		);`,
+		Down: `DROP TABLE recovery_codes;
+		ALTER TABLE users DROP COLUMN totp_counter;
+		ALTER TABLE users DROP COLUMN totp_enabled;
+		ALTER TABLE users DROP COLUMN totp_secret;`,
+	},
+	{
+		Version: 17,
+		Name:    "add login throttles",
+		// Failed logins are counted per username and per IP address, the usernames don't have to exist
+		Up: `CREATE TABLE login_throttles(
+			kind TEXT NOT NULL,
+			value TEXT NOT NULL,
+			failures INTEGER NOT NULL,
+			last_failure DATETIME NOT NULL,
+			locked_until DATETIME NOT NULL,
+			PRIMARY KEY(kind, value)
+		);`,
+		Down: `DROP TABLE login_throttles;`,
+	},
+	{
+		Version: 18,
+		Name:    "add refresh tokens and token revocation",
+		// Only hashes of the refresh tokens are stored. Revoked tokens are only kept until they expire anyway
+		Up: `CREATE TABLE refresh_tokens(
+			token_hash TEXT NOT NULL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			family TEXT NOT NULL,
+			created DATETIME NOT NULL,
+			expires DATETIME NOT NULL,
+			used INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX refresh_tokens_family ON refresh_tokens(family);
+		CREATE INDEX refresh_tokens_user ON refresh_tokens(user_id);
+		CREATE TABLE revoked_tokens(
+			id TEXT NOT NULL PRIMARY KEY,
+			expires DATETIME NOT NULL
+		);`,
+		Down: `DROP TABLE revoked_tokens;
+		DROP TABLE refresh_tokens;`,
+	},
+}
+
+// MigrationStatus describes whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// LatestVersion returns the version of the newest known migration
+func LatestVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// initMigrations creates the table which keeps track of the applied migrations
+func (db *DB) initMigrations() error {
+	q := `CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied DATETIME NOT NULL
+	);`
+	_, err := db.conn.Exec(q)
+	return err
+}
+
+// SchemaVersion returns the version of the newest applied migration, 0 means no migrations have been applied
+func (db *DB) SchemaVersion() (int, error) {
+	if err := db.initMigrations(); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := db.conn.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// MigrationStatus returns all known migrations and whether they have been applied
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	if err := db.initMigrations(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query("SELECT version, applied FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	// Collect the applied migrations by version
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		at, ok := applied[m.Version]
+		status = append(status, MigrationStatus{Migration: m, Applied: ok, AppliedAt: at})
+	}
+
+	return status, nil
+}
+
+// MigrateUp applies all migrations which haven't been applied yet
+func (db *DB) MigrateUp() error {
+	return db.Migrate(LatestVersion())
+}
+
+// Rollback reverts the newest applied migration
+func (db *DB) Rollback() error {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return fmt.Errorf("no migrations to roll back")
+	}
+
+	// Find the migration before the current one
+	target := 0
+	for _, m := range migrations {
+		if m.Version < current {
+			target = m.Version
+		}
+	}
+
+	return db.Migrate(target)
+}
+
+// Migrate migrates the database up or down to the provided version
+// Every migration is applied in its own transaction, so a failing migration leaves the database at the previous version
+func (db *DB) Migrate(target int) error {
+	if target < 0 || target > LatestVersion() {
+		return fmt.Errorf("unknown version %d, latest version is %d", target, LatestVersion())
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	// Migrate up, from the oldest to the newest migration
+	if target > current {
+		for _, m := range migrations {
+			if m.Version <= current || m.Version > target {
+				continue
+			}
+			if err := db.apply(m, true); err != nil {
+				return fmt.Errorf("migration %d (%s) up: %v", m.Version, m.Name, err)
+			}
+		}
+		return nil
+	}
+
+	// Migrate down, from the newest to the oldest migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+		if err := db.apply(m, false); err != nil {
+			return fmt.Errorf("migration %d (%s) down: %v", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// apply runs a single migration in a transaction and records the result in schema_migrations
+func (db *DB) apply(m Migration, up bool) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	q, record := m.Down, "DELETE FROM schema_migrations WHERE version=?"
+	args := []interface{}{m.Version}
+	if up {
+		q, record = m.Up, "INSERT INTO schema_migrations(version, name, applied) values(?, ?, ?)"
+		args = append(args, m.Name, time.Now())
+	}
+
+	// Execute the migration itself, migrations which only have an UpFunc have no SQL to run
+	if q != "" {
+		if _, err := tx.Exec(q); err != nil {
+			tx.Rollback()
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("%v: build with -tags sqlite_fts5", err)
+			}
+			return err
+		}
+	}
+
+	if up && m.UpFunc != nil {
+		if err := m.UpFunc(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// Keep track of the applied migrations
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
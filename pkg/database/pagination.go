@@ -0,0 +1,192 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// Fields posts can be sorted on
+const (
+	SortCreated  = "created"
+	SortModified = "modified"
+	SortTitle    = "title"
+)
+
+// sortTimeFormat is the format in which timestamps are compared
+// It matches strftime('%Y-%m-%d %H:%M:%f') in SQLite, so keys sort the same way as strings and in SQL
+const sortTimeFormat = "2006-01-02 15:04:05.000"
+
+// sqlTime returns the SQL expression which normalizes a timestamp column to UTC with millisecond precision, in
+// sortTimeFormat. Timestamps may be stored in any time zone, so they are always compared this way
+// SQLite rounds to milliseconds where Format truncates, so values which have to match exactly, like the keys of
+// pagination cursors, are selected with this expression instead of being formatted in Go
+func sqlTime(column string) string {
+	return "strftime('%Y-%m-%d %H:%M:%f', " + column + ")"
+}
+
+// sortTime formats a time to be compared with sqlTime
+func sortTime(t time.Time) string {
+	return t.UTC().Format(sortTimeFormat)
+}
+
+// PostSort describes the order of a list of posts
+type PostSort struct {
+	Field string
+	Desc  bool
+}
+
+// DefaultPostSort is the order used when no order is requested, newest posts first
+var DefaultPostSort = PostSort{Field: SortCreated, Desc: true}
+
+// ParsePostSort parses a sort parameter like "title" or "-created", a leading minus means descending
+// An empty string returns DefaultPostSort
+func ParsePostSort(s string) (PostSort, error) {
+	if s == "" {
+		return DefaultPostSort, nil
+	}
+
+	sort := PostSort{Field: strings.TrimPrefix(s, "-"), Desc: strings.HasPrefix(s, "-")}
+	switch sort.Field {
+	case SortCreated, SortModified, SortTitle:
+		return sort, nil
+	}
+
+	return PostSort{}, fmt.Errorf("invalid sort %q", s)
+}
+
+// String returns the sort in the format accepted by ParsePostSort
+func (s PostSort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// key returns the value of the sort field of a post, formatted the way it's compared
+func (s PostSort) key(post models.Post) string {
+	switch s.Field {
+	case SortModified:
+		return sortTime(post.Modified)
+	case SortTitle:
+		return post.Title
+	default:
+		return sortTime(post.Created)
+	}
+}
+
+// visibleWhere limits posts to the ones the viewer passed as its argument is allowed to read
+// Everybody can read published posts, only their author and models.ViewAll can read the others
+const visibleWhere = "(posts.status = 'published' OR ? IN (posts.user_id, -1))"
+
+// PostFilter limits a list of posts, zero values don't filter apart from Viewer
+type PostFilter struct {
+	// From and To limit the posts to the ones created in [From, To)
+	From time.Time
+	To   time.Time
+	// Tag limits the posts to the ones with this normalized tag
+	Tag string
+	// Viewer is the ID of the user reading the posts, unpublished posts are only included for their author and for
+	// models.ViewAll. The zero value is an anonymous reader, who only gets published posts
+	Viewer int64
+}
+
+// where returns the SQL conditions and arguments for the filter, joined with AND
+// The posts are always limited to the ones visible to the viewer
+func (f PostFilter) where() (string, []interface{}) {
+	conds := []string{visibleWhere}
+	args := []interface{}{f.Viewer}
+
+	if !f.From.IsZero() {
+		conds = append(conds, sortColumns[SortCreated]+" >= ?")
+		args = append(args, sortTime(f.From))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, sortColumns[SortCreated]+" < ?")
+		args = append(args, sortTime(f.To))
+	}
+
+	if f.Tag != "" {
+		conds = append(conds, "posts.slug IN (SELECT post_tags.post_slug FROM post_tags JOIN tags ON tags.id = post_tags.tag_id WHERE tags.name = ?)")
+		args = append(args, f.Tag)
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+// match reports whether a post passes the filter
+func (f PostFilter) match(post models.Post) bool {
+	if !post.VisibleTo(f.Viewer) {
+		return false
+	}
+	if !f.From.IsZero() && post.Created.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !post.Created.Before(f.To) {
+		return false
+	}
+	if f.Tag != "" {
+		for _, tag := range post.Tags {
+			if tag == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// PostQuery describes a single page of posts
+type PostQuery struct {
+	// Limit is the maximum number of posts on the page
+	Limit int
+	// Sort is the order of the posts
+	Sort PostSort
+	// Cursor is the NextCursor of the previous page, empty for the first page
+	Cursor string
+	// Filter limits the posts on the page
+	Filter PostFilter
+}
+
+// PostPage is a single page of posts
+type PostPage struct {
+	Posts []models.Post
+	// NextCursor can be used to get the next page, it's empty on the last page
+	NextCursor string
+}
+
+// cursor is the position after which the next page starts
+// The slug breaks ties between posts with the same sort key, because it's unique
+type cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	Slug string `json:"p"`
+}
+
+// encodeCursor creates an opaque cursor pointing after the post with the provided sort key and slug
+func encodeCursor(sort PostSort, key, slug string) string {
+	b, _ := json.Marshal(cursor{Sort: sort.String(), Key: key, Slug: slug})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor decodes an opaque cursor and checks that it was created for the same sort
+func decodeCursor(sort PostSort, s string) (cursor, error) {
+	c := cursor{}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if c.Sort != sort.String() {
+		return c, fmt.Errorf("cursor doesn't match sort %q", sort)
+	}
+
+	return c, nil
+}
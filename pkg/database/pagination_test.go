@@ -0,0 +1,80 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// TestGetPostsSubMillisecond pages through posts whose timestamps have more than millisecond precision
+// SQLite rounds them to milliseconds, the cursors have to hold the same rounded value or pages repeat or skip posts
+func TestGetPostsSubMillisecond(t *testing.T) {
+	db, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+
+	user, err := db.CreateUser(models.User{Username: "bob", Name: "Bob"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every timestamp is rounded up by SQLite and truncated by Format, some posts share a millisecond and some are
+	// stored in another time zone
+	base := time.Date(2020, 1, 2, 3, 4, 5, 577656000, time.UTC)
+	zone := time.FixedZone("EET", 2*60*60)
+	const n = 12
+	for i := 0; i < n; i++ {
+		slug := fmt.Sprintf("post-%02d", i)
+		if _, err := db.CreatePost(models.Post{Slug: slug, UserID: user.ID, Title: slug, Markdown: slug}); err != nil {
+			t.Fatal(err)
+		}
+
+		ts := base.Add(time.Duration(i/2) * time.Millisecond)
+		if i%3 == 0 {
+			ts = ts.In(zone)
+		}
+		if _, err := db.conn.Exec("UPDATE posts SET created = ?, modified = ? WHERE slug = ?", ts, ts, slug); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, field := range []string{SortCreated, SortModified} {
+		for _, desc := range []bool{false, true} {
+			sort := PostSort{Field: field, Desc: desc}
+			t.Run(sort.String(), func(t *testing.T) {
+				seen := make(map[string]bool)
+				query := PostQuery{Limit: 1, Sort: sort, Filter: PostFilter{Viewer: models.ViewAll}}
+				for pages := 0; ; pages++ {
+					if pages > n {
+						t.Fatalf("more than %d pages for %d posts", n, n)
+					}
+
+					page, err := db.GetPosts(query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, post := range page.Posts {
+						if seen[post.Slug] {
+							t.Fatalf("post %s is returned again on page %d", post.Slug, pages+1)
+						}
+						seen[post.Slug] = true
+					}
+
+					if page.NextCursor == "" {
+						break
+					}
+					query.Cursor = page.NextCursor
+				}
+
+				if len(seen) != n {
+					t.Errorf("got %d posts, want %d", len(seen), n)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// tokenExpires is the expiry of a password reset token, to be compared with sortTime
+var tokenExpires = sqlTime("password_reset_tokens.expires")
+
+// CreatePasswordResetToken stores the hash of a new password reset token for a user, valid until expires
+// Older tokens of the user are removed, only the newest link works. Expired tokens of all users are cleaned up as well
+func (db *DB) CreatePasswordResetToken(userID int64, tokenHash string, expires time.Time) error {
+	now := time.Now()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	q := "DELETE FROM password_reset_tokens WHERE user_id=? OR " + tokenExpires + " <= ?"
+	if _, err := tx.Exec(q, userID, sortTime(now)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	q = "INSERT INTO password_reset_tokens(token_hash, user_id, created, expires) values(?, ?, ?, ?)"
+	if _, err := tx.Exec(q, tokenHash, userID, now, expires); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetPasswordResetUser gets the user a password reset token was issued for, without using the token
+// Returns sql.ErrNoRows if the token doesn't exist or has expired
+func (db *DB) GetPasswordResetUser(tokenHash string, now time.Time) (models.User, error) {
+	q := "SELECT " + userColumns + ` FROM password_reset_tokens JOIN users ON users.id = password_reset_tokens.user_id
+	WHERE password_reset_tokens.token_hash=? AND ` + tokenExpires + " > ?"
+	return scanUser(db.conn.QueryRow(q, tokenHash, sortTime(now)))
+}
+
+// UsePasswordResetToken uses up a password reset token and returns the user it was issued for
+// All tokens of the user are removed, so a token can only be used once
+// Returns sql.ErrNoRows if the token doesn't exist, has expired or has been used already
+func (db *DB) UsePasswordResetToken(tokenHash string, now time.Time) (models.User, error) {
+	user, err := db.GetPasswordResetUser(tokenHash, now)
+	if err != nil {
+		return user, err
+	}
+
+	// Deleting the token decides who used it, when the token is used twice at the same time only one delete succeeds
+	res, err := db.conn.Exec("DELETE FROM password_reset_tokens WHERE token_hash=?", tokenHash)
+	if err != nil {
+		return user, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return user, err
+	}
+	if n == 0 {
+		return models.User{}, sql.ErrNoRows
+	}
+
+	// The other tokens of the user are no longer needed
+	if _, err := db.conn.Exec("DELETE FROM password_reset_tokens WHERE user_id=?", user.ID); err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
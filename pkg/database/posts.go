@@ -1,47 +1,206 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golangbg/web-api-development-demo/pkg/models"
+	"github.com/mattn/go-sqlite3"
 )
 
-// SavePost saves a post to the database
-func (db *DB) SavePost(post models.Post) (models.Post, error) {
-	// Get the current time
-	now := time.Now()
+// ErrPostExists is returned by CreatePost when a post with the same slug already exists
+var ErrPostExists = errors.New("a post with this slug already exists")
 
-	// If post.Created has a zero value, this is a new post, so let's set the creation date and time
-	if post.Created.IsZero() {
-		post.Created = now
+// postColumns are the columns selected for a post, in the order scanPost expects them
+// The tags of a post are aggregated into a comma separated list
+const postColumns = `posts.slug, posts.user_id, users.name, posts.title, posts.body, posts.markdown, posts.created, posts.modified,
+	posts.status, posts.publish_at, posts.auto_approve_comments,
+	(SELECT GROUP_CONCAT(tags.name) FROM post_tags JOIN tags ON tags.id = post_tags.tag_id WHERE post_tags.post_slug = posts.slug)`
+
+// postTables joins the posts with their authors
+const postTables = "posts LEFT JOIN users ON posts.user_id = users.id"
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPost scans a row selected with postColumns into a post
+func scanPost(row scanner) (models.Post, error) {
+	post := models.Post{}
+	var (
+		publishAt sql.NullTime
+		tags      sql.NullString
+	)
+	if err := row.Scan(&post.Slug, &post.UserID, &post.Author, &post.Title, &post.Body, &post.Markdown, &post.Created, &post.Modified,
+		&post.Status, &publishAt, &post.AutoApproveComments, &tags); err != nil {
+		return post, err
 	}
-	post.Modified = now
+	post.PublishAt = publishAt.Time
 
-	// Prepare the query
-	q := `INSERT OR REPLACE INTO posts(slug, user_id, title, body, created, modified)
-	values(?, ?, ?, ?, ?, ?)`
-	stmt, err := db.conn.Prepare(q)
+	post.Tags = []string{}
+	if tags.String != "" {
+		post.Tags = models.NormalizeTags(strings.Split(tags.String, ","))
+	}
+
+	return post, nil
+}
+
+// nullTime converts a zero time to NULL, so unset times aren't stored as a date in year 1
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// CreatePost inserts a new post into the database
+// Returns ErrPostExists if a post with the same slug already exists, an existing post is never overwritten
+func (db *DB) CreatePost(post models.Post) (models.Post, error) {
+	// This is a new post, so let's set the creation and modification date and time
+	post.Created = time.Now()
+	post.Modified = post.Created
+
+	post.Tags = models.NormalizeTags(post.Tags)
+	post.UpdateStatus(post.Created)
+
+	// Sanitize the body here as well, so no write path can store HTML the policy doesn't allow
+	post.Sanitize()
+
+	// The post, its tags, the search index and the revision are saved in a single transaction
+	tx, err := db.conn.Begin()
 	if err != nil {
-		// Preparing the query went wrong, so we'll return an empty post and the error
 		return models.Post{}, err
 	}
-	// Make sure stmt gets closed
-	defer stmt.Close()
 
 	// Ececute the query
-	if _, err := stmt.Exec(post.Slug, post.UserID, post.Title, post.Body, post.Created, post.Modified); err != nil {
+	q := `INSERT INTO posts(slug, user_id, title, body, markdown, created, modified, status, publish_at, auto_approve_comments)
+	values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(q, post.Slug, post.UserID, post.Title, post.Body, post.Markdown, post.Created, post.Modified,
+		post.Status, nullTime(post.PublishAt), post.AutoApproveComments); err != nil {
+		tx.Rollback()
+
+		// The slug is the primary key, so a constraint violation means the post already exists
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return models.Post{}, ErrPostExists
+		}
+
 		// Execution went wrong, so we'll return an empty post and the error
 		return models.Post{}, err
 	}
 
+	// Save the tags
+	if err := setPostTags(tx, post.Slug, post.Tags); err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	// Add the post to the search index
+	if err := setPostSearch(tx, post); err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	// Keep the first version of the post
+	if err := addRevision(tx, post); err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	// The slug belongs to this post now, so it no longer redirects
+	if err := deleteSlugRedirects(tx, post.Slug); err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Post{}, err
+	}
+
+	// Everything went well, let's return the post and nil for the error
+	return post, nil
+}
+
+// UpdatePost updates the title, body, markdown, tags, publication state and comment settings of the post with the
+// provided slug. If post.Slug is another slug, the post is renamed to it in the same transaction, so either both the
+// slug and the content change or neither does. The author and creation date of the post are left untouched
+// Returns sql.ErrNoRows if there is no post with the provided slug, a missing post is never inserted, and
+// ErrPostExists if the new slug is taken
+func (db *DB) UpdatePost(slug string, post models.Post) (models.Post, error) {
+	post.Modified = time.Now()
+	post.Tags = models.NormalizeTags(post.Tags)
+	post.UpdateStatus(post.Modified)
+
+	// Sanitize the body here as well, so no write path can store HTML the policy doesn't allow
+	post.Sanitize()
+
+	// The slug, the post, its tags, the search index and the revision are saved in a single transaction
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return models.Post{}, err
+	}
+
+	// Rename the post first, the update below finds it by its new slug
+	if post.Slug != slug {
+		if err := renamePost(tx, slug, post.Slug); err != nil {
+			tx.Rollback()
+			return models.Post{}, err
+		}
+	}
+
+	// Execute the query
+	q := "UPDATE posts SET title=?, body=?, markdown=?, modified=?, status=?, publish_at=?, auto_approve_comments=? WHERE slug=?"
+	res, err := tx.Exec(q, post.Title, post.Body, post.Markdown, post.Modified, post.Status, nullTime(post.PublishAt),
+		post.AutoApproveComments, post.Slug)
+	if err != nil {
+		// Execution went wrong, so we'll return an empty post and the error
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	// Check if a post was actually updated
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return models.Post{}, sql.ErrNoRows
+	}
+
+	// Replace the tags, tags which are no longer used are removed
+	if err := setPostTags(tx, post.Slug, post.Tags); err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	// Update the search index
+	if err := setPostSearch(tx, post); err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	// Keep the new version of the post, the previous versions are left untouched
+	if err := addRevision(tx, post); err != nil {
+		tx.Rollback()
+		return models.Post{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Post{}, err
+	}
+
 	// Everything went well, let's return the post and nil for the error
 	return post, nil
 }
 
 // GetPostBySlug gets a post by it's slug
-func (db *DB) GetPostBySlug(slug string) (post models.Post, err error) {
+// viewer is the ID of the user reading the post, 0 for anonymous readers. Unpublished posts are only returned to their author
+// and to models.ViewAll
+func (db *DB) GetPostBySlug(slug string, viewer int64) (post models.Post, err error) {
 	// Prepare the query
-	q := "SELECT posts.slug, posts.user_id, users.name, posts.title, posts.body, posts.created, posts.modified FROM posts LEFT JOIN users ON posts.user_id = users.id WHERE slug=?"
+	q := "SELECT " + postColumns + " FROM " + postTables + " WHERE slug=? AND " + visibleWhere
 	stmt, err := db.conn.Prepare(q)
 	if err != nil {
 		// Preparing the query went wrong, so we'll return an empty post and the error
@@ -51,18 +210,16 @@ func (db *DB) GetPostBySlug(slug string) (post models.Post, err error) {
 	defer stmt.Close()
 
 	// Get the post
-	if err := stmt.QueryRow(slug).Scan(&post.Slug, &post.UserID, &post.Author, &post.Title, &post.Body, &post.Created, &post.Modified); err != nil {
-		return post, err
-	}
-
-	return post, err
+	return scanPost(stmt.QueryRow(slug, viewer))
 }
 
 // GetAllPosts gets all posts from the database
-func (db *DB) GetAllPosts() (posts []models.Post, err error) {
+// viewer is the ID of the user reading the posts, 0 for anonymous readers. Unpublished posts are only returned to their author
+// and to models.ViewAll
+func (db *DB) GetAllPosts(viewer int64) (posts []models.Post, err error) {
 	// Prepare the query
-	q := "SELECT posts.slug, posts.user_id, users.name, posts.title, posts.body, posts.created, posts.modified FROM posts LEFT JOIN users ON posts.user_id = users.id ORDER BY datetime(created) DESC"
-	rows, err := db.conn.Query(q)
+	q := "SELECT " + postColumns + " FROM " + postTables + " WHERE " + visibleWhere + " ORDER BY datetime(created) DESC"
+	rows, err := db.conn.Query(q, viewer)
 	if err != nil {
 		// Query preparation went wrong
 		return posts, err
@@ -72,10 +229,9 @@ func (db *DB) GetAllPosts() (posts []models.Post, err error) {
 
 	// Loop over the received rows and store them in posts
 	for rows.Next() {
-		// Initialize an empty post
-		post := models.Post{}
-		// Fill the post through the row
-		if err := rows.Scan(&post.Slug, &post.UserID, &post.Author, &post.Title, &post.Body, &post.Created, &post.Modified); err != nil {
+		// Fill a post through the row
+		post, err := scanPost(rows)
+		if err != nil {
 			return posts, err
 		}
 
@@ -85,3 +241,297 @@ func (db *DB) GetAllPosts() (posts []models.Post, err error) {
 
 	return posts, err
 }
+
+// DeletePost deletes a post by it's slug
+// Returns sql.ErrNoRows if there is no post with the provided slug
+func (db *DB) DeletePost(slug string) error {
+	// The post, its tags, its search index entry, its revisions, its redirects and its comments are deleted in a single transaction
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Execute the query
+	res, err := tx.Exec("DELETE FROM posts WHERE slug=?", slug)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Check if a post was actually deleted
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+
+	// Remove the tags of the post
+	if err := setPostTags(tx, slug, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Remove the post from the search index
+	if err := deletePostSearch(tx, slug); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Remove the history of the post
+	if err := deleteRevisions(tx, slug); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Remove the redirects to the post
+	if err := deleteSlugRedirects(tx, slug); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Remove the comments on the post
+	if err := deleteComments(tx, slug); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SanitizePosts runs the body of every post through models.Policy again, Markdown posts are rendered again
+// Use it after the policy has changed or for posts stored before sanitization existed
+// Only posts whose body changes are updated, their modification date is left untouched. Returns the slugs of those posts
+func (db *DB) SanitizePosts() (changed []string, err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT slug, title, body, markdown FROM posts")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Read all posts first, the transaction can't be used while the rows are open
+	posts := []models.Post{}
+	for rows.Next() {
+		post := models.Post{}
+		if err := rows.Scan(&post.Slug, &post.Title, &post.Body, &post.Markdown); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for _, post := range posts {
+		body := post.Body
+		if err := post.Render(); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("post %s: %v", post.Slug, err)
+		}
+		if post.Body == body {
+			continue
+		}
+
+		if _, err := tx.Exec("UPDATE posts SET body=? WHERE slug=?", post.Body, post.Slug); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := setPostSearch(tx, post); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		changed = append(changed, post.Slug)
+	}
+
+	return changed, tx.Commit()
+}
+
+// PublishDuePosts publishes the scheduled posts whose PublishAt has passed
+// Returns the slugs of the published posts
+func (db *DB) PublishDuePosts(now time.Time) (published []string, err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	due := "status = 'scheduled' AND " + sqlTime("publish_at") + " <= ?"
+	dueArg := sortTime(now)
+
+	rows, err := tx.Query("SELECT slug FROM posts WHERE "+due, dueArg)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		published = append(published, slug)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE posts SET status = 'published' WHERE "+due, dueArg); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return published, tx.Commit()
+}
+
+// sortColumns maps the sort fields to the SQL expressions they are ordered by
+// Timestamps are normalized to UTC with millisecond precision, see sqlTime
+var sortColumns = map[string]string{
+	SortCreated:  sqlTime("posts.created"),
+	SortModified: sqlTime("posts.modified"),
+	SortTitle:    "posts.title",
+}
+
+// GetPosts gets a single page of posts from the database
+// Pagination uses the position of the last post instead of an offset, so pages stay consistent while posts are added
+func (db *DB) GetPosts(query PostQuery) (page PostPage, err error) {
+	column, ok := sortColumns[query.Sort.Field]
+	if !ok {
+		return page, fmt.Errorf("invalid sort %q", query.Sort.Field)
+	}
+	if query.Limit <= 0 {
+		return page, fmt.Errorf("invalid limit %d", query.Limit)
+	}
+
+	dir, op := "ASC", ">"
+	if query.Sort.Desc {
+		dir, op = "DESC", "<"
+	}
+
+	where, args := query.Filter.where()
+
+	// Continue after the cursor if one is provided
+	if query.Cursor != "" {
+		c, err := decodeCursor(query.Sort, query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		where += fmt.Sprintf(" AND (%s, posts.slug) %s (?, ?)", column, op)
+		args = append(args, c.Key, c.Slug)
+	}
+
+	// Get one post more than requested, so we know whether there is a next page
+	args = append(args, query.Limit+1)
+
+	// The sort key is selected as well, so the cursor holds exactly the value the next page is compared with
+	q := fmt.Sprintf(`SELECT %s, %s FROM %s
+	WHERE %s
+	ORDER BY %s %s, posts.slug %s
+	LIMIT ?`, postColumns, column, postTables, where, column, dir, dir)
+	rows, err := db.conn.Query(q, args...)
+	if err != nil {
+		return page, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		post, err := scanPost(extraScanner{rows, []interface{}{&key}})
+		if err != nil {
+			return page, err
+		}
+		page.Posts = append(page.Posts, post)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	// Drop the extra post and point the cursor at the last post of this page
+	if len(page.Posts) > query.Limit {
+		page.Posts = page.Posts[:query.Limit]
+		last := page.Posts[len(page.Posts)-1]
+		page.NextCursor = encodeCursor(query.Sort, keys[query.Limit-1], last.Slug)
+	}
+
+	return page, nil
+}
+
+// GetPostsByPage gets a numbered page of posts, newest first
+// Pages start at 1
+func (db *DB) GetPostsByPage(filter PostFilter, page, perPage int) (posts []models.Post, err error) {
+	if page < 1 || perPage < 1 {
+		return posts, fmt.Errorf("invalid page %d", page)
+	}
+
+	where, args := filter.where()
+	args = append(args, perPage, (page-1)*perPage)
+
+	q := fmt.Sprintf(`SELECT %s FROM %s
+	WHERE %s
+	ORDER BY %s DESC, posts.slug DESC
+	LIMIT ? OFFSET ?`, postColumns, postTables, where, sortColumns[SortCreated])
+	rows, err := db.conn.Query(q, args...)
+	if err != nil {
+		return posts, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return posts, err
+		}
+		posts = append(posts, post)
+	}
+
+	return posts, rows.Err()
+}
+
+// CountPosts counts the posts which pass the filter
+func (db *DB) CountPosts(filter PostFilter) (count int, err error) {
+	where, args := filter.where()
+	err = db.conn.QueryRow("SELECT COUNT(*) FROM posts WHERE "+where, args...).Scan(&count)
+	return count, err
+}
+
+// GetArchive gets the number of published posts per month, newest month first
+func (db *DB) GetArchive() (archive []models.ArchiveMonth, err error) {
+	q := `SELECT CAST(strftime('%Y', created) AS INTEGER) AS year, CAST(strftime('%m', created) AS INTEGER) AS month, COUNT(*)
+	FROM posts
+	WHERE status = 'published'
+	GROUP BY year, month
+	ORDER BY year DESC, month DESC`
+	rows, err := db.conn.Query(q)
+	if err != nil {
+		return archive, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	for rows.Next() {
+		month := models.ArchiveMonth{}
+		if err := rows.Scan(&month.Year, &month.Month, &month.Count); err != nil {
+			return archive, err
+		}
+		archive = append(archive, month)
+	}
+
+	return archive, rows.Err()
+}
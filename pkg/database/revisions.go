@@ -0,0 +1,78 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// revisionColumns are the columns selected for a revision, in the order scanRevision expects them
+const revisionColumns = `post_revisions.id, post_revisions.post_slug, post_revisions.user_id, users.name, post_revisions.title,
+	post_revisions.body, post_revisions.markdown, post_revisions.tags, post_revisions.created`
+
+// revisionTables joins the revisions with their authors
+const revisionTables = "post_revisions LEFT JOIN users ON post_revisions.user_id = users.id"
+
+// scanRevision scans a row selected with revisionColumns into a revision
+func scanRevision(row scanner) (models.Revision, error) {
+	rev := models.Revision{}
+	var (
+		author sql.NullString
+		tags   string
+	)
+	if err := row.Scan(&rev.ID, &rev.Slug, &rev.UserID, &author, &rev.Title, &rev.Body, &rev.Markdown, &tags, &rev.Created); err != nil {
+		return rev, err
+	}
+	rev.Author = author.String
+
+	rev.Tags = []string{}
+	if tags != "" {
+		rev.Tags = models.NormalizeTags(strings.Split(tags, ","))
+	}
+
+	return rev, nil
+}
+
+// addRevision stores the current content of a post as a new revision, written by the editor of the post
+// The tags are stored as a comma separated list, normalized tags never contain commas
+func addRevision(tx *sql.Tx, post models.Post) error {
+	q := `INSERT INTO post_revisions(post_slug, user_id, title, body, markdown, tags, created)
+	values(?, ?, ?, ?, ?, ?, ?)`
+	_, err := tx.Exec(q, post.Slug, post.Editor(), post.Title, post.Body, post.Markdown, strings.Join(post.Tags, ","), post.Modified)
+	return err
+}
+
+// deleteRevisions removes all revisions of a post
+func deleteRevisions(tx *sql.Tx, slug string) error {
+	_, err := tx.Exec("DELETE FROM post_revisions WHERE post_slug=?", slug)
+	return err
+}
+
+// GetRevisions gets all revisions of a post, newest first
+func (db *DB) GetRevisions(slug string) (revisions []models.Revision, err error) {
+	q := "SELECT " + revisionColumns + " FROM " + revisionTables + " WHERE post_revisions.post_slug=? ORDER BY post_revisions.id DESC"
+	rows, err := db.conn.Query(q, slug)
+	if err != nil {
+		return revisions, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, rows.Err()
+}
+
+// GetRevision gets a single revision of a post
+// Returns sql.ErrNoRows if the post has no revision with the provided ID
+func (db *DB) GetRevision(slug string, id int64) (models.Revision, error) {
+	q := "SELECT " + revisionColumns + " FROM " + revisionTables + " WHERE post_revisions.post_slug=? AND post_revisions.id=?"
+	return scanRevision(db.conn.QueryRow(q, slug, id))
+}
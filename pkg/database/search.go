@@ -0,0 +1,227 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// ErrSearchUnavailable is returned by SearchPosts when the blog is built without FTS5, see searchEnabled
+var ErrSearchUnavailable = errors.New("search is not available, the blog is built without FTS5")
+
+// snippetTokens is the maximum number of tokens in a search snippet
+const snippetTokens = 24
+
+// searchTerms turns user input into an FTS5 query
+// Every word is quoted, so FTS5 operators in the input are searched for literally, and all words must match
+func searchTerms(query string) string {
+	terms := []string{}
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.Replace(word, `"`, `""`, -1)+`"`)
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// createSearchIndex creates the search index and indexes all posts, unless the blog is built without FTS5
+func createSearchIndex(tx *sql.Tx) error {
+	if !searchEnabled {
+		return nil
+	}
+
+	// The slug is only stored to link a result to its post
+	_, err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+		slug UNINDEXED,
+		title,
+		body,
+		tokenize = 'unicode61 remove_diacritics 2'
+	);`)
+	if err != nil {
+		return err
+	}
+
+	return rebuildSearchIndex(tx)
+}
+
+// hasSearchIndex checks if the search index table exists, which can be done without FTS5
+func (db *DB) hasSearchIndex() (exists bool, err error) {
+	err = db.conn.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name='posts_fts')").Scan(&exists)
+	return exists, err
+}
+
+// checkSearchIndex makes sure the search index matches the build of the blog
+// A database migrated by a build without FTS5 gets its index once it's opened by a build with FTS5. The other way
+// around is refused, the index can't be kept up to date without FTS5 and would return outdated results later on
+func (db *DB) checkSearchIndex() error {
+	exists, err := db.hasSearchIndex()
+	if err != nil {
+		return err
+	}
+	if exists == searchEnabled {
+		return nil
+	}
+	if exists {
+		return fmt.Errorf("the database has a search index which needs FTS5: build with -tags sqlite_fts5")
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := createSearchIndex(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setPostSearch replaces a post in the search index
+func setPostSearch(tx *sql.Tx, post models.Post) error {
+	if !searchEnabled {
+		return nil
+	}
+
+	if err := deletePostSearch(tx, post.Slug); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("INSERT INTO posts_fts(slug, title, body) values(?, ?, ?)", post.Slug, post.Title, post.PlainText())
+	return err
+}
+
+// deletePostSearch removes a post from the search index
+func deletePostSearch(tx *sql.Tx, slug string) error {
+	if !searchEnabled {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM posts_fts WHERE slug=?", slug)
+	return err
+}
+
+// renamePostSearch moves the search index entry of a post to its new slug
+func renamePostSearch(tx *sql.Tx, oldSlug, newSlug string) error {
+	if !searchEnabled {
+		return nil
+	}
+
+	_, err := tx.Exec("UPDATE posts_fts SET slug=? WHERE slug=?", newSlug, oldSlug)
+	return err
+}
+
+// rebuildSearchIndex empties the search index and indexes all posts again
+func rebuildSearchIndex(tx *sql.Tx) error {
+	if !searchEnabled {
+		return nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM posts_fts"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT slug, title, body FROM posts")
+	if err != nil {
+		return err
+	}
+
+	// Read all posts first, the transaction can't be used while the rows are open
+	posts := []models.Post{}
+	for rows.Next() {
+		post := models.Post{}
+		if err := rows.Scan(&post.Slug, &post.Title, &post.Body); err != nil {
+			rows.Close()
+			return err
+		}
+		posts = append(posts, post)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		if _, err := tx.Exec("INSERT INTO posts_fts(slug, title, body) values(?, ?, ?)", post.Slug, post.Title, post.PlainText()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RebuildSearchIndex rebuilds the full-text search index from the posts table
+func (db *DB) RebuildSearchIndex() error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := rebuildSearchIndex(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SearchPosts searches the title and body of all published posts, the best matches come first
+// Matches in the title weigh heavier than matches in the body
+func (db *DB) SearchPosts(query string, limit, offset int) (results []models.SearchResult, err error) {
+	if !searchEnabled {
+		return results, ErrSearchUnavailable
+	}
+
+	terms := searchTerms(query)
+	if terms == "" {
+		return results, fmt.Errorf("empty query")
+	}
+	if limit <= 0 || offset < 0 {
+		return results, fmt.Errorf("invalid limit %d", limit)
+	}
+
+	q := fmt.Sprintf(`SELECT %s,
+		snippet(posts_fts, 2, ?, ?, '…', %d),
+		bm25(posts_fts, 0.0, 10.0, 1.0) AS rank
+	FROM posts_fts
+	JOIN posts ON posts.slug = posts_fts.slug
+	LEFT JOIN users ON posts.user_id = users.id
+	WHERE posts_fts MATCH ? AND posts.status = 'published'
+	ORDER BY rank, posts.slug
+	LIMIT ? OFFSET ?`, postColumns, snippetTokens)
+	rows, err := db.conn.Query(q, models.SnippetMatchStart, models.SnippetMatchEnd, terms, limit, offset)
+	if err != nil {
+		return results, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			snippet string
+			result  models.SearchResult
+		)
+		result.Post, err = scanPost(extraScanner{rows, []interface{}{&snippet, &result.Rank}})
+		if err != nil {
+			return results, err
+		}
+		result.Snippet = models.HighlightSnippet(snippet)
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// extraScanner scans additional columns after the ones requested by the caller
+// It allows scanPost to be used for queries which select more than postColumns
+type extraScanner struct {
+	scanner
+	extra []interface{}
+}
+
+// Scan scans the row into dest followed by the extra destinations
+func (e extraScanner) Scan(dest ...interface{}) error {
+	return e.scanner.Scan(append(dest, e.extra...)...)
+}
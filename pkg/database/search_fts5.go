@@ -0,0 +1,7 @@
+//go:build sqlite_fts5
+
+package database
+
+// searchEnabled tells if the SQLite driver is built with FTS5, which the full-text search index needs
+// The sqlite_fts5 build tag of github.com/mattn/go-sqlite3 enables it, search_nofts5.go is used without the tag
+const searchEnabled = true
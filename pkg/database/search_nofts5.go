@@ -0,0 +1,7 @@
+//go:build !sqlite_fts5
+
+package database
+
+// searchEnabled tells if the SQLite driver is built with FTS5, which the full-text search index needs
+// Without the sqlite_fts5 build tag the blog works without a search index and SearchPosts returns ErrSearchUnavailable
+const searchEnabled = false
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+	"github.com/mattn/go-sqlite3"
+)
+
+// maxSlugCandidates is the number of suffixes AvailableSlug tries before giving up
+const maxSlugCandidates = 1000
+
+// AvailableSlug returns the first slug based on base which isn't reserved, used by a post or redirected
+// Collisions are resolved with a numbered suffix: base, base-2, base-3 and so on
+func (db *DB) AvailableSlug(base string) (string, error) {
+	q := `SELECT EXISTS(SELECT 1 FROM posts WHERE slug=?) OR EXISTS(SELECT 1 FROM slug_redirects WHERE old_slug=?)`
+	for n := 1; n <= maxSlugCandidates; n++ {
+		slug := models.SlugCandidate(base, n)
+		if models.IsReservedSlug(slug) {
+			continue
+		}
+
+		var taken bool
+		if err := db.conn.QueryRow(q, slug, slug).Scan(&taken); err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+	}
+
+	return "", fmt.Errorf("no slug available for %q", base)
+}
+
+// renamePost changes the slug of a post and leaves a redirect from the old slug to the new one
+// Existing redirects to the old slug are pointed at the new one, so redirects are never chained
+// It's part of the transaction of UpdatePost, the caller rolls back when an error is returned
+// Returns ErrPostExists if the new slug is taken and sql.ErrNoRows if there is no post with the old slug
+func renamePost(tx *sql.Tx, oldSlug, newSlug string) error {
+	res, err := tx.Exec("UPDATE posts SET slug=? WHERE slug=?", newSlug, oldSlug)
+	if err != nil {
+		// The slug is the primary key, so a constraint violation means the new slug is taken
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return ErrPostExists
+		}
+		return err
+	}
+
+	// Check if a post was actually renamed
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	// Move the tags, the revisions and the comments along, then update the redirects
+	queries := []struct {
+		q    string
+		args []interface{}
+	}{
+		{"UPDATE post_tags SET post_slug=? WHERE post_slug=?", []interface{}{newSlug, oldSlug}},
+		{"UPDATE post_revisions SET post_slug=? WHERE post_slug=?", []interface{}{newSlug, oldSlug}},
+		{"UPDATE comments SET post_slug=? WHERE post_slug=?", []interface{}{newSlug, oldSlug}},
+		{"DELETE FROM slug_redirects WHERE old_slug=?", []interface{}{newSlug}},
+		{"UPDATE slug_redirects SET new_slug=? WHERE new_slug=?", []interface{}{newSlug, oldSlug}},
+		{"INSERT OR REPLACE INTO slug_redirects(old_slug, new_slug, created) values(?, ?, ?)", []interface{}{oldSlug, newSlug, time.Now()}},
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query.q, query.args...); err != nil {
+			return err
+		}
+	}
+
+	return renamePostSearch(tx, oldSlug, newSlug)
+}
+
+// GetSlugRedirect returns the slug an old slug redirects to
+// Returns sql.ErrNoRows if there is no redirect for the slug
+func (db *DB) GetSlugRedirect(slug string) (newSlug string, err error) {
+	err = db.conn.QueryRow("SELECT new_slug FROM slug_redirects WHERE old_slug=?", slug).Scan(&newSlug)
+	return newSlug, err
+}
+
+// deleteSlugRedirects removes the redirects from and to a slug
+// A redirect from the slug would hide a new post with it, a redirect to it would point at nothing
+func deleteSlugRedirects(tx *sql.Tx, slug string) error {
+	_, err := tx.Exec("DELETE FROM slug_redirects WHERE old_slug=? OR new_slug=?", slug, slug)
+	return err
+}
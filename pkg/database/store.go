@@ -0,0 +1,127 @@
+package database
+
+import (
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// Store describes the post and user operations the server needs from a storage backend
+// DB is the SQLite implementation, Memory keeps everything in memory
+type Store interface {
+	// CreatePost inserts a new post, returns ErrPostExists if the slug is already taken
+	CreatePost(post models.Post) (models.Post, error)
+	// UpdatePost updates the existing post with the slug, returns sql.ErrNoRows if the post doesn't exist
+	// If post.Slug is another slug the post is renamed to it along with the update, and a redirect is left behind
+	// Returns ErrPostExists if the new slug is taken, the post is left untouched then
+	UpdatePost(slug string, post models.Post) (models.Post, error)
+	// DeletePost deletes a post, returns sql.ErrNoRows if the post doesn't exist
+	DeletePost(slug string) error
+	// AvailableSlug returns the first free slug based on base, collisions get a numbered suffix
+	AvailableSlug(base string) (string, error)
+	// GetSlugRedirect returns the slug an old slug redirects to, returns sql.ErrNoRows if there is no redirect
+	GetSlugRedirect(slug string) (string, error)
+	// GetPostBySlug gets a post, returns sql.ErrNoRows if the post doesn't exist or isn't visible to the viewer
+	// viewer is the ID of the user reading the post, 0 for anonymous readers and models.ViewAll for editors
+	GetPostBySlug(slug string, viewer int64) (models.Post, error)
+	// GetAllPosts gets all posts visible to the viewer, newest first
+	GetAllPosts(viewer int64) ([]models.Post, error)
+	// GetPosts gets a single page of posts
+	GetPosts(query PostQuery) (PostPage, error)
+	// GetPostsByPage gets a numbered page of posts, newest first
+	GetPostsByPage(filter PostFilter, page, perPage int) ([]models.Post, error)
+	// CountPosts counts the posts which pass the filter
+	CountPosts(filter PostFilter) (int, error)
+	// GetArchive gets the number of published posts per month, newest month first
+	GetArchive() ([]models.ArchiveMonth, error)
+	// GetTags gets all tags with the number of published posts using them, ordered by name
+	GetTags() ([]models.Tag, error)
+	// PublishDuePosts publishes the scheduled posts which are due, returns their slugs
+	PublishDuePosts(now time.Time) ([]string, error)
+	// GetRevisions gets all revisions of a post, newest first
+	GetRevisions(slug string) ([]models.Revision, error)
+	// GetRevision gets a revision of a post, returns sql.ErrNoRows if it doesn't exist
+	GetRevision(slug string, id int64) (models.Revision, error)
+	// CreateComment adds a comment to a post, comments without a status are pending
+	// Returns ErrCommentParent if the parent isn't an approved comment on the same post
+	CreateComment(comment models.Comment) (models.Comment, error)
+	// GetComments gets the comments on a post with the provided status, oldest first. An empty status gets all comments
+	GetComments(slug, status string) ([]models.Comment, error)
+	// SetCommentStatus changes the moderation state of a comment, returns sql.ErrNoRows if the comment doesn't exist
+	SetCommentStatus(slug string, id int64, status string) (models.Comment, error)
+	// IsApprovedCommenter reports whether a user had a comment approved before
+	IsApprovedCommenter(userID int64) (bool, error)
+	// SearchPosts searches the title and body of all published posts, the best matches come first
+	SearchPosts(query string, limit, offset int) ([]models.SearchResult, error)
+
+	// CreateUser inserts a new user, the password is hashed if it isn't empty. Users without a role get models.DefaultRole
+	// Returns ErrUserExists if the username is taken regardless of case, an existing user is never overwritten
+	CreateUser(user models.User, password string) (models.User, error)
+	// GetUserByID gets a user by its ID, returns sql.ErrNoRows if the user doesn't exist
+	GetUserByID(id int64) (models.User, error)
+	// GetUserByUsername gets a user regardless of the case of the username, returns sql.ErrNoRows if the user doesn't exist
+	GetUserByUsername(username string) (models.User, error)
+	// GetUsers gets all users, ordered by username
+	GetUsers() ([]models.User, error)
+	// GetUsersByEmail gets the users with an email address regardless of case, ordered by username
+	GetUsersByEmail(email string) ([]models.User, error)
+	// UpdateUser updates the name, email address, role and account state of a user found by its ID, keeping its ID and username
+	// The password is hashed and replaced if it isn't empty, which ends a forced password reset and revokes the refresh
+	// tokens of the user
+	// Returns sql.ErrNoRows if the user doesn't exist
+	UpdateUser(user models.User, password string) (models.User, error)
+	// SetUserRole changes the role of a user, returns sql.ErrNoRows if the user doesn't exist
+	SetUserRole(username, role string) error
+	// CreatePasswordResetToken stores the hash of a password reset token for a user, older tokens of the user are removed
+	CreatePasswordResetToken(userID int64, tokenHash string, expires time.Time) error
+	// GetPasswordResetUser gets the user of a password reset token without using it
+	// Returns sql.ErrNoRows if the token doesn't exist or has expired
+	GetPasswordResetUser(tokenHash string, now time.Time) (models.User, error)
+	// UsePasswordResetToken uses up a password reset token and returns its user, all tokens of the user are removed
+	// Returns sql.ErrNoRows if the token doesn't exist, has expired or has been used already
+	UsePasswordResetToken(tokenHash string, now time.Time) (models.User, error)
+	// SetUserTOTP stores the TOTP secret of a user and whether two-factor authentication is enabled, returns
+	// sql.ErrNoRows if the user doesn't exist
+	SetUserTOTP(userID int64, secret string, enabled bool) error
+	// UseTOTPCounter records the time step of a used TOTP code, returns ErrTOTPCodeUsed if it isn't newer than the last
+	UseTOTPCounter(userID int64, counter int64) error
+	// ReplaceRecoveryCodes replaces the hashed recovery codes of a user
+	ReplaceRecoveryCodes(userID int64, codeHashes []string) error
+	// UseRecoveryCode uses up a recovery code, returns sql.ErrNoRows if the user has no code with the hash
+	UseRecoveryCode(userID int64, codeHash string) error
+	// CountRecoveryCodes returns how many unused recovery codes a user has left
+	CountRecoveryCodes(userID int64) (int, error)
+	// GetLoginThrottle gets the login throttle of a username or an IP address, returns sql.ErrNoRows if there is none
+	GetLoginThrottle(kind, value string) (models.LoginThrottle, error)
+	// GetLoginThrottles gets the login throttles with failures since the provided time or still locked out at it
+	GetLoginThrottles(since time.Time) ([]models.LoginThrottle, error)
+	// RecordLoginFailure counts a failed login for a username or an IP address, failures before resetBefore are forgotten
+	RecordLoginFailure(kind, value string, now, resetBefore time.Time) (models.LoginThrottle, error)
+	// LockLogins locks out the logins of a username or an IP address, returns sql.ErrNoRows if there is no throttle
+	LockLogins(kind, value string, until time.Time) error
+	// ClearLoginThrottle lifts the lockout of a username or an IP address, returns sql.ErrNoRows if there is none
+	ClearLoginThrottle(kind, value string) error
+	// CreateRefreshToken stores the hash of a refresh token of the API
+	CreateRefreshToken(t models.RefreshToken) error
+	// UseRefreshToken marks a refresh token as used, returns sql.ErrNoRows if it doesn't exist or has expired and
+	// ErrRefreshTokenUsed if it was used already
+	UseRefreshToken(tokenHash string, now time.Time) (models.RefreshToken, error)
+	// RevokeRefreshTokens deletes all refresh tokens of a family
+	RevokeRefreshTokens(family string) error
+	// RevokeToken adds the ID of a token to the revocation list until it expires
+	RevokeToken(id string, expires time.Time) error
+	// IsTokenRevoked reports whether the ID of a token is on the revocation list
+	IsTokenRevoked(id string) (bool, error)
+	// DeleteUser deletes a user and keeps its comments as anonymous comments
+	// Returns ErrUserHasPosts if the user still has posts, sql.ErrNoRows if the user doesn't exist
+	DeleteUser(username string) error
+
+	// CloseDB releases the resources held by the store
+	CloseDB() error
+}
+
+// Make sure both implementations satisfy the Store interface at compile time
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*Memory)(nil)
+)
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// setPostTags replaces the tags of a post and removes tags which are no longer used by any post
+// The tags are expected to be normalized
+func setPostTags(tx *sql.Tx, slug string, tags []string) error {
+	// Remove the current tags of the post
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE post_slug=?", slug); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		// Create the tag if it doesn't exist yet
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags(name) values(?)", tag); err != nil {
+			return err
+		}
+
+		// Link the tag to the post
+		q := "INSERT INTO post_tags(post_slug, tag_id) SELECT ?, id FROM tags WHERE name=?"
+		if _, err := tx.Exec(q, slug, tag); err != nil {
+			return err
+		}
+	}
+
+	// Clean up the tags which aren't used anymore
+	_, err := tx.Exec("DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM post_tags)")
+	return err
+}
+
+// GetTags gets all tags with the number of published posts using them, ordered by name
+// Tags which are only used by unpublished posts are left out
+func (db *DB) GetTags() (tags []models.Tag, err error) {
+	q := `SELECT tags.name, COUNT(post_tags.post_slug)
+	FROM tags JOIN post_tags ON post_tags.tag_id = tags.id
+	JOIN posts ON posts.slug = post_tags.post_slug
+	WHERE posts.status = 'published'
+	GROUP BY tags.id
+	ORDER BY tags.name`
+	rows, err := db.conn.Query(q)
+	if err != nil {
+		return tags, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	for rows.Next() {
+		tag := models.Tag{}
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return tags, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// The timestamps of the login throttles, to be compared with sortTime
+var (
+	throttleLastFailure = sqlTime("login_throttles.last_failure")
+	throttleLockedUntil = sqlTime("login_throttles.locked_until")
+)
+
+// throttleColumns are the columns selected for a login throttle, in the order scanThrottle expects them
+const throttleColumns = "kind, value, failures, last_failure, locked_until"
+
+// scanThrottle scans a row selected with throttleColumns into a login throttle
+func scanThrottle(row scanner) (t models.LoginThrottle, err error) {
+	err = row.Scan(&t.Kind, &t.Value, &t.Failures, &t.LastFailure, &t.LockedUntil)
+	return t, err
+}
+
+// GetLoginThrottle gets the login throttle of a username or an IP address
+// Returns sql.ErrNoRows if there were no failed logins for it
+func (db *DB) GetLoginThrottle(kind, value string) (models.LoginThrottle, error) {
+	q := "SELECT " + throttleColumns + " FROM login_throttles WHERE kind=? AND value=?"
+	return scanThrottle(db.conn.QueryRow(q, kind, value))
+}
+
+// GetLoginThrottles gets the login throttles which had a failed login since the provided time, or which are still
+// locked out at it, the most recent failures first
+func (db *DB) GetLoginThrottles(since time.Time) (throttles []models.LoginThrottle, err error) {
+	q := "SELECT " + throttleColumns + " FROM login_throttles WHERE " + throttleLastFailure + " > ? OR " +
+		throttleLockedUntil + " > ? ORDER BY " + throttleLastFailure + " DESC"
+	t := sortTime(since)
+	rows, err := db.conn.Query(q, t, t)
+	if err != nil {
+		return throttles, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	throttles = []models.LoginThrottle{}
+	for rows.Next() {
+		throttle, err := scanThrottle(rows)
+		if err != nil {
+			return throttles, err
+		}
+		throttles = append(throttles, throttle)
+	}
+
+	return throttles, rows.Err()
+}
+
+// RecordLoginFailure counts a failed login for a username or an IP address at now, and returns the updated throttle
+// Failures from before resetBefore are forgotten, the count starts over. Throttles which are neither recent nor locked
+// are cleaned up as well
+func (db *DB) RecordLoginFailure(kind, value string, now, resetBefore time.Time) (models.LoginThrottle, error) {
+	reset := sortTime(resetBefore)
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return models.LoginThrottle{}, err
+	}
+
+	q := "DELETE FROM login_throttles WHERE " + throttleLastFailure + " <= ? AND " + throttleLockedUntil + " <= ?"
+	if _, err := tx.Exec(q, reset, sortTime(now)); err != nil {
+		tx.Rollback()
+		return models.LoginThrottle{}, err
+	}
+
+	// The count is increased in the database, so failures at the same time are all counted
+	q = `INSERT INTO login_throttles(kind, value, failures, last_failure, locked_until) values(?, ?, 1, ?, ?)
+	ON CONFLICT(kind, value) DO UPDATE SET failures=failures+1, last_failure=excluded.last_failure`
+	if _, err := tx.Exec(q, kind, value, now, time.Time{}); err != nil {
+		tx.Rollback()
+		return models.LoginThrottle{}, err
+	}
+
+	q = "SELECT " + throttleColumns + " FROM login_throttles WHERE kind=? AND value=?"
+	throttle, err := scanThrottle(tx.QueryRow(q, kind, value))
+	if err != nil {
+		tx.Rollback()
+		return throttle, err
+	}
+
+	return throttle, tx.Commit()
+}
+
+// LockLogins locks out the logins of a username or an IP address until the provided time
+// Returns sql.ErrNoRows if there were no failed logins for it
+func (db *DB) LockLogins(kind, value string, until time.Time) error {
+	res, err := db.conn.Exec("UPDATE login_throttles SET locked_until=? WHERE kind=? AND value=?", until, kind, value)
+	if err != nil {
+		return err
+	}
+
+	// Check if a throttle was actually changed
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ClearLoginThrottle forgets the failed logins of a username or an IP address and lifts its lockout
+// Returns sql.ErrNoRows if there were no failed logins for it
+func (db *DB) ClearLoginThrottle(kind, value string) error {
+	res, err := db.conn.Exec("DELETE FROM login_throttles WHERE kind=? AND value=?", kind, value)
+	if err != nil {
+		return err
+	}
+
+	// Check if a throttle was actually deleted
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// ErrRefreshTokenUsed is returned by UseRefreshToken when the refresh token was exchanged already
+var ErrRefreshTokenUsed = errors.New("the refresh token has been used already")
+
+// The expiry of the tokens, to be compared with sortTime
+var (
+	refreshTokenExpires = sqlTime("refresh_tokens.expires")
+	revokedTokenExpires = sqlTime("revoked_tokens.expires")
+)
+
+// refreshTokenColumns are the columns selected for a refresh token, in the order scanRefreshToken expects them
+const refreshTokenColumns = "token_hash, user_id, family, created, expires, used"
+
+// scanRefreshToken scans a row selected with refreshTokenColumns into a refresh token
+func scanRefreshToken(row scanner) (t models.RefreshToken, err error) {
+	err = row.Scan(&t.TokenHash, &t.UserID, &t.Family, &t.Created, &t.Expires, &t.Used)
+	return t, err
+}
+
+// CreateRefreshToken stores the hash of a new refresh token
+// Expired tokens of all users are cleaned up as well
+func (db *DB) CreateRefreshToken(t models.RefreshToken) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	q := "DELETE FROM refresh_tokens WHERE " + refreshTokenExpires + " <= ?"
+	if _, err := tx.Exec(q, sortTime(t.Created)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	q = "INSERT INTO refresh_tokens(" + refreshTokenColumns + ") values(?, ?, ?, ?, ?, ?)"
+	if _, err := tx.Exec(q, t.TokenHash, t.UserID, t.Family, t.Created, t.Expires, t.Used); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRefreshToken marks a refresh token as used and returns it, so it can't be exchanged again
+// Returns sql.ErrNoRows if the token doesn't exist or has expired, and ErrRefreshTokenUsed together with the token if
+// it was used already
+func (db *DB) UseRefreshToken(tokenHash string, now time.Time) (models.RefreshToken, error) {
+	q := "SELECT " + refreshTokenColumns + " FROM refresh_tokens WHERE token_hash=? AND " + refreshTokenExpires + " > ?"
+	t, err := scanRefreshToken(db.conn.QueryRow(q, tokenHash, sortTime(now)))
+	if err != nil {
+		return t, err
+	}
+	if t.Used {
+		return t, ErrRefreshTokenUsed
+	}
+
+	// Marking the token decides who used it, when the token is used twice at the same time only one update succeeds
+	res, err := db.conn.Exec("UPDATE refresh_tokens SET used=1 WHERE token_hash=? AND used=0", tokenHash)
+	if err != nil {
+		return t, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return t, err
+	}
+	if n == 0 {
+		return t, ErrRefreshTokenUsed
+	}
+
+	t.Used = true
+	return t, nil
+}
+
+// RevokeRefreshTokens deletes all refresh tokens of a family, none of them can be exchanged anymore
+func (db *DB) RevokeRefreshTokens(family string) error {
+	_, err := db.conn.Exec("DELETE FROM refresh_tokens WHERE family=?", family)
+	return err
+}
+
+// RevokeToken adds the ID of a token to the revocation list, until the token expires anyway
+// Expired tokens are cleaned up from the list as well
+func (db *DB) RevokeToken(id string, expires time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	q := "DELETE FROM revoked_tokens WHERE " + revokedTokenExpires + " <= ?"
+	if _, err := tx.Exec(q, sortTime(time.Now())); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Revoking a token twice does no harm
+	q = "INSERT INTO revoked_tokens(id, expires) values(?, ?) ON CONFLICT(id) DO NOTHING"
+	if _, err := tx.Exec(q, id, expires); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// IsTokenRevoked reports whether the ID of a token is on the revocation list
+func (db *DB) IsTokenRevoked(id string) (bool, error) {
+	var n int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE id=?", id).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
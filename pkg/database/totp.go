@@ -0,0 +1,98 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrTOTPCodeUsed is returned by UseTOTPCounter when a code of the same or a later time step was used already
+var ErrTOTPCodeUsed = errors.New("the code has been used already, wait for the next one")
+
+// SetUserTOTP stores the TOTP secret of a user and whether two-factor authentication is enabled
+// A secret which isn't enabled yet is waiting for the user to confirm the enrollment with a code. The counter of the
+// last used code is kept, it's a time step so the codes of a new secret are newer anyway
+// Returns sql.ErrNoRows if the user doesn't exist
+func (db *DB) SetUserTOTP(userID int64, secret string, enabled bool) error {
+	res, err := db.conn.Exec("UPDATE users SET totp_secret=?, totp_enabled=? WHERE id=?", secret, enabled, userID)
+	if err != nil {
+		return err
+	}
+
+	// Check if a user was actually changed
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// UseTOTPCounter records that the TOTP code of a time step was used by a user, so the code can't be used again
+// Returns ErrTOTPCodeUsed if a code of the same or a later time step was used before
+func (db *DB) UseTOTPCounter(userID int64, counter int64) error {
+	res, err := db.conn.Exec("UPDATE users SET totp_counter=? WHERE id=? AND totp_counter < ?", counter, userID, counter)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTOTPCodeUsed
+	}
+
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user with the provided hashes, no hashes remove them all
+func (db *DB) ReplaceRecoveryCodes(userID int64, codeHashes []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id=?", userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes(user_id, code_hash) values(?, ?)", userID, hash); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode uses up a recovery code of a user, so it can't be used again
+// Returns sql.ErrNoRows if the user has no recovery code with the hash
+func (db *DB) UseRecoveryCode(userID int64, codeHash string) error {
+	res, err := db.conn.Exec("DELETE FROM recovery_codes WHERE user_id=? AND code_hash=?", userID, codeHash)
+	if err != nil {
+		return err
+	}
+
+	// The code is used by whoever deleted it, so it can't be used twice at the same time
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (db *DB) CountRecoveryCodes(userID int64) (n int, err error) {
+	err = db.conn.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id=?", userID).Scan(&n)
+	return n, err
+}
@@ -1,26 +1,62 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
+
 	"github.com/golangbg/web-api-development-demo/pkg/models"
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (db *DB) SaveUser(user models.User, password string) (models.User, error) {
+// ErrUserExists is returned by CreateUser when the username is taken, usernames are compared regardless of case
+var ErrUserExists = errors.New("username taken")
+
+// ErrUserHasPosts is returned by DeleteUser when the user still has posts, those would lose their author
+var ErrUserHasPosts = errors.New("the user still has posts")
+
+// userColumns are the columns selected for a user, in the order scanUser expects them
+const userColumns = `users.id, users.username, users.name, users.email, users.email_verified, users.password, users.role,
+	users.disabled, users.password_reset, users.totp_secret, users.totp_enabled`
+
+// scanUser scans a row selected with userColumns into a user
+func scanUser(row scanner) (user models.User, err error) {
+	err = row.Scan(&user.ID, &user.Username, &user.Name, &user.Email, &user.EmailVerified, &user.Password, &user.Role,
+		&user.Disabled, &user.PasswordReset, &user.TOTPSecret, &user.TOTPEnabled)
+	return user, err
+}
+
+// hashPassword hashes a password so it can be stored
+func hashPassword(password string) (string, error) {
+	// Passwords need to be stored encrypted in the database
+	// We can hash the password with the bcrypt package (https://godoc.org/golang.org/x/crypto/bcrypt#GenerateFromPassword)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	// The hashed password is stored as a string
+	return string(hash), nil
+}
+
+// CreateUser inserts a new user into the database, the password is hashed if it isn't empty
+// Users without a role get models.DefaultRole
+// Returns ErrUserExists if the username is taken, an existing user is never overwritten
+func (db *DB) CreateUser(user models.User, password string) (models.User, error) {
 	if password != "" {
-		// Passwords need to be stored encrypted in the database
-		// We can hash the password with the bcrypt package (https://godoc.org/golang.org/x/crypto/bcrypt#GenerateFromPassword)
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hash, err := hashPassword(password)
 		if err != nil {
 			return user, err
 		}
-
-		// The hashed password is stored as a string
-		user.Password = string(hash)
+		user.Password = hash
+	}
+	if user.Role == "" {
+		user.Role = models.DefaultRole
 	}
 
 	// Prepare the query
-	q := `INSERT OR REPLACE INTO users(username, name, password)
-	values(?, ?, ?)`
+	q := `INSERT INTO users(username, name, email, email_verified, password, role)
+	values(?, ?, ?, ?, ?, ?)`
 	stmt, err := db.conn.Prepare(q)
 	if err != nil {
 		// Preparing the query went wrong, so we'll return an empty post and the error
@@ -30,8 +66,13 @@ func (db *DB) SaveUser(user models.User, password string) (models.User, error) {
 	defer stmt.Close()
 
 	// Ececute the query
-	res, err := stmt.Exec(user.Username, user.Name, user.Password)
+	res, err := stmt.Exec(user.Username, user.Name, user.Email, user.EmailVerified, user.Password, user.Role)
 	if err != nil {
+		// The usernames are unique regardless of case, so a constraint violation means the username is taken
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return models.User{}, ErrUserExists
+		}
+
 		// Execution went wrong, so we'll return an empty post and the error
 		return models.User{}, err
 	}
@@ -44,10 +85,15 @@ func (db *DB) SaveUser(user models.User, password string) (models.User, error) {
 	return user, nil
 }
 
-// GetUserByUsername gets a user by the username
+// GetUserByID gets a user by its ID, returns sql.ErrNoRows if the user doesn't exist
+func (db *DB) GetUserByID(id int64) (models.User, error) {
+	return scanUser(db.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE users.id=?", id))
+}
+
+// GetUserByUsername gets a user by the username, regardless of case
 func (db *DB) GetUserByUsername(username string) (user models.User, err error) {
 	// Prepare the query
-	q := "SELECT * FROM users WHERE username=?"
+	q := "SELECT " + userColumns + " FROM users WHERE users.username=? COLLATE NOCASE"
 	stmt, err := db.conn.Prepare(q)
 	if err != nil {
 		// Preparing the query went wrong, so we'll return an empty user and the error
@@ -57,9 +103,174 @@ func (db *DB) GetUserByUsername(username string) (user models.User, err error) {
 	defer stmt.Close()
 
 	// Get the user
-	if err := stmt.QueryRow(username).Scan(&user.ID, &user.Username, &user.Name, &user.Password); err != nil {
+	return scanUser(stmt.QueryRow(username))
+}
+
+// GetUsers gets all users, ordered by username
+func (db *DB) GetUsers() (users []models.User, err error) {
+	rows, err := db.conn.Query("SELECT " + userColumns + " FROM users ORDER BY users.username")
+	if err != nil {
+		return users, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	users = []models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetUsersByEmail gets the users with an email address, regardless of case. Several users may share an address
+func (db *DB) GetUsersByEmail(email string) (users []models.User, err error) {
+	users = []models.User{}
+	if email == "" {
+		return users, nil
+	}
+
+	rows, err := db.conn.Query("SELECT "+userColumns+" FROM users WHERE users.email=? COLLATE NOCASE ORDER BY users.username", email)
+	if err != nil {
+		return users, err
+	}
+	// Make sure the rows iterator gets closed
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// UpdateUser updates the name, email address and its verification, role and account state of an existing user, the user is found by its ID
+// The password is replaced if a new one is provided, which ends a forced password reset and revokes the refresh tokens
+// of the user. The row is updated in place, so the ID stays the same and the posts of the user keep their author
+// The username never changes. Returns sql.ErrNoRows if the user doesn't exist
+func (db *DB) UpdateUser(user models.User, password string) (models.User, error) {
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return user, err
+		}
+		user.Password = hash
+		user.PasswordReset = false
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
 		return user, err
 	}
 
-	return user, err
+	q := "UPDATE users SET name=?, email=?, email_verified=?, password=?, role=?, disabled=?, password_reset=? WHERE id=?"
+	res, err := tx.Exec(q, user.Name, user.Email, user.EmailVerified, user.Password, user.Role, user.Disabled,
+		user.PasswordReset, user.ID)
+	if err != nil {
+		tx.Rollback()
+		return user, err
+	}
+
+	// Check if a user was actually updated
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return user, sql.ErrNoRows
+	}
+
+	// A new password ends the API sessions on all devices, whoever knew the old password has to log in again
+	if password != "" {
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id=?", user.ID); err != nil {
+			tx.Rollback()
+			return user, err
+		}
+	}
+
+	return user, tx.Commit()
+}
+
+// DeleteUser deletes a user, returns ErrUserHasPosts if the user still has posts
+// The comments of the user are kept as anonymous comments under the username. Returns sql.ErrNoRows if there is no user
+// with the provided username
+func (db *DB) DeleteUser(username string) error {
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	// The posts are counted, the comments are detached and the user is deleted in a single transaction, so a post
+	// created in the meantime can't be left without its author
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	var posts int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id=?", user.ID).Scan(&posts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if posts > 0 {
+		tx.Rollback()
+		return ErrUserHasPosts
+	}
+
+	if _, err := tx.Exec("UPDATE comments SET user_id=NULL, name=? WHERE user_id=?", user.Username, user.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE user_id=?", user.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id=?", user.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id=?", user.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM users WHERE id=?", user.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetUserRole changes the role of a user
+// Returns sql.ErrNoRows if there is no user with the provided username
+func (db *DB) SetUserRole(username, role string) error {
+	res, err := db.conn.Exec("UPDATE users SET role=? WHERE username=? COLLATE NOCASE", role, username)
+	if err != nil {
+		return err
+	}
+
+	// Check if a user was actually changed
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
 }
@@ -0,0 +1,126 @@
+// Package mailer sends the emails of the blog, like password reset links
+// Mailer is the extension point, SMTPMailer delivers the emails and FileMailer and LogMailer keep them local for
+// development
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is an email to a single recipient, the body is plain text
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails, implement it to plug in another way of delivering them
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// format formats the message as an email from the sender, with the headers and a quoted-printable body
+// Line breaks are removed from the header values, so they can't be used to add headers
+func (msg Message) format(from string) ([]byte, error) {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", clean.Replace(from))
+	fmt.Fprintf(buf, "To: %s\r\n", clean.Replace(msg.To))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", clean.Replace(msg.Subject)))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	// Addr is the host:port of the SMTP server
+	Addr string
+	// From is the sender of the emails
+	From string
+	// Username and Password are used for PLAIN authentication, which the server only allows over TLS
+	// Leave the Username empty for servers which don't require authentication
+	Username string
+	Password string
+}
+
+// Send sends the message through the SMTP server
+func (m SMTPMailer) Send(msg Message) error {
+	data, err := msg.format(m.From)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, data)
+}
+
+// FileMailer writes every email to a file in a directory instead of sending it, for local development
+// The files can be opened with any email client
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Send writes the message to a new .eml file in the directory
+func (m FileMailer) Send(msg Message) error {
+	data, err := msg.format(m.From)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+
+	// The time keeps the files in order, the recipient tells them apart. Only safe characters end up in the name
+	to := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '@' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, msg.To)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), to)
+
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), data, 0600)
+}
+
+// LogMailer writes every email to the log instead of sending it, for local development
+type LogMailer struct{}
+
+// Send logs the message
+func (LogMailer) Send(msg Message) error {
+	log.Printf("email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ArchiveMonth is the number of posts created in a single month
+type ArchiveMonth struct {
+	Year  int
+	Month time.Month
+	Count int
+}
+
+// Name returns the month in a human readable format, for example "September 2018"
+func (a ArchiveMonth) Name() string {
+	return fmt.Sprintf("%s %d", a.Month, a.Year)
+}
+
+// Path returns the URL of the archive page of the month
+func (a ArchiveMonth) Path() string {
+	return fmt.Sprintf("/archive/%04d/%02d", a.Year, a.Month)
+}
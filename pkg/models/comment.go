@@ -0,0 +1,119 @@
+package models
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits for the fields of a comment
+const (
+	MaxCommentLength = 5000
+	MaxCommenterName = 64
+)
+
+// The moderation states of a comment, only approved comments are shown
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentRejected = "rejected"
+	CommentSpam     = "spam"
+)
+
+// CommentActions maps the moderation actions to the state they put a comment in
+var CommentActions = map[string]string{
+	"approve": CommentApproved,
+	"reject":  CommentRejected,
+	"spam":    CommentSpam,
+}
+
+// ValidCommentStatus reports whether status is one of the moderation states
+func ValidCommentStatus(status string) bool {
+	switch status {
+	case CommentPending, CommentApproved, CommentRejected, CommentSpam:
+		return true
+	}
+	return false
+}
+
+// Comment is a comment on a post, replies point to the comment they reply to with ParentID
+// Comments of logged in users are linked to the user with UserID, anonymous comments carry a name and an email address
+type Comment struct {
+	ID       int64  `json:"id"`
+	Slug     string `json:"slug"`
+	ParentID int64  `json:"parent_id,omitempty"`
+	UserID   int64  `json:"-"`
+	Name     string `json:"name"`
+	// Email is never sent by the API, only the moderation page of the web interface shows it to the users who can
+	// moderate the post
+	Email   string    `json:"-"`
+	Body    string    `json:"body"`
+	Created time.Time `json:"created"`
+	// Status is the moderation state, SpamScore is the score the SpamScorer gave the comment
+	Status    string  `json:"status"`
+	SpamScore float64 `json:"spam_score,omitempty"`
+	// Replies is filled by ThreadComments
+	Replies []Comment `json:"replies,omitempty"`
+}
+
+// Validate performs a validation check on the comment's data
+// Returns an error in case of a validation error
+// Returns nil if validation passed
+func (c Comment) Validate() error {
+	if c.Slug == "" {
+		return ValidationError{"Slug", "empty"}
+	}
+
+	if strings.TrimSpace(c.Body) == "" {
+		return ValidationError{"Body", "empty"}
+	}
+	if utf8.RuneCountInString(c.Body) > MaxCommentLength {
+		return ValidationError{"Body", "too long"}
+	}
+
+	// Logged in users are known already, anonymous commenters have to introduce themselves
+	if c.UserID == 0 {
+		if strings.TrimSpace(c.Name) == "" {
+			return ValidationError{"Name", "empty"}
+		}
+		if utf8.RuneCountInString(c.Name) > MaxCommenterName {
+			return ValidationError{"Name", "too long"}
+		}
+		if _, err := mail.ParseAddress(c.Email); err != nil {
+			return ValidationError{"Email", "invalid value"}
+		}
+	}
+
+	return nil
+}
+
+// ThreadComments turns a list of comments, oldest first, into a tree of comments with their replies
+// Replies whose parent isn't in the list are shown at the top level
+func ThreadComments(comments []Comment) []Comment {
+	// Collect the replies per parent, keeping their order
+	children := make(map[int64][]Comment)
+	known := make(map[int64]bool)
+	for _, c := range comments {
+		known[c.ID] = true
+	}
+	for _, c := range comments {
+		parent := c.ParentID
+		if !known[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], c)
+	}
+
+	var build func(parent int64) []Comment
+	build = func(parent int64) []Comment {
+		thread := []Comment{}
+		for _, c := range children[parent] {
+			c.Replies = build(c.ID)
+			thread = append(thread, c)
+		}
+		return thread
+	}
+
+	return build(0)
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// markdown converts Markdown to HTML (https://github.com/yuin/goldmark)
+// GitHub Flavored Markdown adds tables, strikethrough, autolinks and task lists. Fenced code blocks are part of CommonMark
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	// Give every heading an id, so it can be linked to with an anchor
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	// Raw HTML is kept, the output is sanitized afterwards
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// RenderMarkdown converts Markdown to HTML sanitized with Policy
+func RenderMarkdown(src string) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(src), &buf); err != nil {
+		return "", err
+	}
+
+	return template.HTML(SanitizeHTML(buf.String())), nil
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits for passwords, bcrypt only uses the first 72 bytes of a password
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+// ValidatePassword checks a new password against the password policy: it has to be long enough, and it can't be the
+// username or one of the passwords which are tried first when accounts are attacked
+// Returns nil if the password is acceptable
+func ValidatePassword(password, username string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return ValidationError{"Password", fmt.Sprintf("has to be at least %d characters", MinPasswordLength)}
+	}
+	if len(password) > MaxPasswordLength {
+		return ValidationError{"Password", fmt.Sprintf("can't be longer than %d bytes", MaxPasswordLength)}
+	}
+
+	if username != "" && strings.EqualFold(password, username) {
+		return ValidationError{"Password", "can't be the username"}
+	}
+	if IsCommonPassword(password) {
+		return ValidationError{"Password", "is too common, it appears in lists of breached passwords"}
+	}
+
+	return nil
+}
+
+// IsCommonPassword reports whether a password is on the bundled list of breached passwords, ignoring case
+func IsCommonPassword(password string) bool {
+	return commonPasswords[strings.ToLower(password)]
+}
+
+// commonPasswords contains the most common passwords from public breach compilations, in lower case
+// Passwords shorter than MinPasswordLength are left out, the length check rejects them already
+var commonPasswords = make(map[string]bool)
+
+func init() {
+	for _, p := range strings.Fields(commonPasswordList) {
+		commonPasswords[p] = true
+	}
+}
+
+// commonPasswordList is the bundled list of breached passwords, separated by whitespace
+const commonPasswordList = `
+12345678 123456789 1234567890 12345678910 0123456789 987654321 87654321 11111111 1111111111 00000000 88888888
+66666666 99999999 12341234 11223344 12121212 123123123 123321123 147258369 159753456 741852963 789456123 123456123
+password password1 password12 password123 password1234 password! password01 password2 passw0rd p@ssw0rd p@ssword
+pa55word pa$$word passpass password11 mypassword newpassword qwertyuiop qwertyui qwerty12 qwerty123 qwerty1234
+qwert123 qwer1234 1234qwer 1q2w3e4r 1q2w3e4r5t 1q2w3e4r5t6y q1w2e3r4 q1w2e3r4t5 1qaz2wsx 1qaz2wsx3edc zaq12wsx
+zaq1zaq1 qazwsxedc qazwsx123 123qweasd 123qweasdzxc qweasdzxc qweasd123 asdfghjkl asdfghjk asdf1234 asdfasdf
+zxcvbnm1 zxcvbnm123 zxcvzxcv abcd1234 abc12345 abc123456 aa123456 a1234567 a12345678 aa12345678 iloveyou
+iloveyou1 iloveyou2 iloveu123 sunshine sunshine1 princess princess1 football football1 baseball baseball1
+basketball welcome1 welcome123 welcome2 letmein1 letmein123 trustno1 superman superman1 batman123 spiderman
+starwars starwars1 whatever michelle jennifer jessica1 samantha charlie1 michael1 matthew1 anthony1 daniel123
+ashley123 nicole123 jordan23 computer corvette mercedes maverick internet blahblah hello123 helloworld
+chocolate butterfly liverpool arsenal1 chelsea1 manchester barcelona pokemon1 master123 monkey123 dragon123
+shadow123 changeme changeme1 administrator adminadmin admin123 admin1234 root1234 rootroot test1234 testtest
+test12345 guest123 default1 secret123 lovelove loveyou1 babygirl1 fuckyou1 football12 michelle1 1234abcd
+123abc123 abcdefgh abcdefg1 abcdefgh1 aaaaaaaa qqqqqqqq 1password 7777777777 5555555555 18atcskd2w 3rjs1la7qe
+`
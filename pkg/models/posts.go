@@ -1,26 +1,146 @@
 package models
 
 import (
+	"html"
 	"html/template"
 	"regexp"
+	"strings"
 	"time"
 )
 
+// Publication states of a post
+const (
+	// StatusDraft posts are only visible to their author
+	StatusDraft = "draft"
+	// StatusScheduled posts are only visible to their author until they are published at PublishAt
+	StatusScheduled = "scheduled"
+	// StatusPublished posts are visible to everybody
+	StatusPublished = "published"
+)
+
 // Post is a blog post using tags for (un)marshalling to/from json (https://golang.org/pkg/encoding/json/)
 type Post struct {
 	Slug     string        `json:"slug"`
 	UserID   int64         `json:"-"`
 	Author   string        `json:"author"`
 	Title    string        `json:"title"`
-	Body     template.HTML `json:"body"` // Prevents escaping of HTML (https://golang.org/pkg/html/template/#HTML)
+	Body     template.HTML `json:"body"`               // Prevents escaping of HTML (https://golang.org/pkg/html/template/#HTML)
+	Markdown string        `json:"markdown,omitempty"` // The source of Body, if the post was written in Markdown
+	Tags     []string      `json:"tags"`
 	Created  time.Time     `json:"created"`
 	Modified time.Time     `json:"modified"`
+	// Status is one of StatusDraft, StatusScheduled or StatusPublished
+	Status string `json:"status"`
+	// PublishAt is when a scheduled post will be published, or when a published post was published
+	PublishAt time.Time `json:"publish_at"`
+	// AutoApproveComments publishes comments of users who have had a comment approved before without moderation
+	// Anonymous comments are always moderated
+	AutoApproveComments bool `json:"auto_approve_comments"`
+	// EditorID is the user saving the post, it's recorded in the revision. 0 means the author
+	EditorID int64 `json:"-"`
+}
+
+// ViewAll can be passed as the viewer of posts to see the unpublished posts of all authors, see User.Viewer
+const ViewAll int64 = -1
+
+// TagList returns the tags as a comma separated list, as used in forms
+func (p Post) TagList() string {
+	return strings.Join(p.Tags, ", ")
+}
+
+// PublishAtFormat is the format of PublishAt in forms, as used by datetime-local inputs
+const PublishAtFormat = "2006-01-02T15:04"
+
+// PublishAtInput returns PublishAt in the local time zone, as used in forms. Returns an empty string if it isn't set
+func (p Post) PublishAtInput() string {
+	if p.PublishAt.IsZero() {
+		return ""
+	}
+	return p.PublishAt.Local().Format(PublishAtFormat)
+}
+
+// Render renders Markdown into Body, the Body of posts without Markdown is sanitized
+// Either way Body only contains HTML allowed by Policy afterwards
+func (p *Post) Render() error {
+	if p.Markdown == "" {
+		p.Sanitize()
+		return nil
+	}
+
+	body, err := RenderMarkdown(p.Markdown)
+	if err != nil {
+		return err
+	}
+	p.Body = body
+
+	return nil
+}
+
+// Published reports whether the post is visible to everybody
+func (p Post) Published() bool {
+	return p.Status == StatusPublished
+}
+
+// VisibleTo reports whether the user with the provided ID is allowed to read the post
+// Unpublished posts are only visible to their author and to ViewAll, 0 is an anonymous reader
+func (p Post) VisibleTo(userID int64) bool {
+	return p.Published() || userID == ViewAll || (userID != 0 && userID == p.UserID)
+}
+
+// Editor returns the ID of the user saving the post: EditorID if it's set, otherwise the author
+func (p Post) Editor() int64 {
+	if p.EditorID != 0 {
+		return p.EditorID
+	}
+	return p.UserID
+}
+
+// UpdateStatus fills in the defaults of the publication state and publishes a scheduled post which is due
+// Posts without a status are published, like all posts were before the publication states existed
+func (p *Post) UpdateStatus(now time.Time) {
+	switch p.Status {
+	case "":
+		p.Status = StatusPublished
+	case StatusScheduled:
+		if !p.PublishAt.After(now) {
+			p.Status = StatusPublished
+		}
+	}
+
+	// A post published by hand is published now, unless it was published before
+	if p.Status == StatusPublished && (p.PublishAt.IsZero() || p.PublishAt.After(now)) {
+		p.PublishAt = now
+	}
+}
+
+// Sanitize removes everything Policy doesn't allow from Body
+func (p *Post) Sanitize() {
+	p.Body = template.HTML(SanitizeHTML(string(p.Body)))
+}
+
+// Source returns the text to edit the post with: the Markdown, or Body for posts written in HTML
+// Markdown may contain HTML, so an HTML post can be edited as Markdown
+func (p Post) Source() string {
+	if p.Markdown != "" {
+		return p.Markdown
+	}
+	return string(p.Body)
+}
+
+// tagRegexp matches HTML tags
+var tagRegexp = regexp.MustCompile("<.*?>")
+
+// PlainText returns Body stripped of all HTML tags, with HTML entities unescaped
+func (p Post) PlainText() string {
+	txt := html.UnescapeString(tagRegexp.ReplaceAllString(string(p.Body), " "))
+
+	// Collapse the whitespace left behind by the tags
+	return strings.Join(strings.Fields(txt), " ")
 }
 
 // Preview returns strips Body of all HTML tags and returns the first 100 characters
 func (p Post) Preview() string {
-	re := regexp.MustCompile("<.*?>")
-	txt := re.ReplaceAllString(string(p.Body), "")
+	txt := tagRegexp.ReplaceAllString(string(p.Body), "")
 
 	chars := 100
 	if l := len(txt); l < chars {
@@ -33,17 +153,35 @@ func (p Post) Preview() string {
 // Returns an error in case of a validation error
 // Returns nil if validation passed
 func (p Post) Validate() error {
-	if p.Slug == "" {
-		return ValidationError{"Slug", "invalid value"}
-	}
-
 	if p.Title == "" {
 		return ValidationError{"Title", "empty"}
 	}
 
+	// The slug rules of ValidateSlug are checked when a slug is chosen, on creation or renaming. Posts created before
+	// the rules existed keep their slug, so they can still be edited and restored
+	if p.Slug == "" {
+		return ValidationError{"Slug", "empty"}
+	}
+
 	if p.UserID <= 0 {
 		return ValidationError{"UserID", "invalid value"}
 	}
 
+	switch p.Status {
+	case "", StatusDraft, StatusPublished:
+	case StatusScheduled:
+		if p.PublishAt.IsZero() {
+			return ValidationError{"PublishAt", "empty"}
+		}
+	default:
+		return ValidationError{"Status", "invalid value"}
+	}
+
+	for _, tag := range NormalizeTags(p.Tags) {
+		if len(tag) > MaxTagLength {
+			return ValidationError{"Tags", "tag too long: " + tag}
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Revision is the content of a post as it was saved at a certain moment
+// A revision is stored every time a post is created, updated or restored
+type Revision struct {
+	ID       int64         `json:"id"`
+	Slug     string        `json:"slug"`
+	UserID   int64         `json:"-"`
+	Author   string        `json:"author"`
+	Title    string        `json:"title"`
+	Body     template.HTML `json:"body"`
+	Markdown string        `json:"markdown,omitempty"`
+	Tags     []string      `json:"tags"`
+	Created  time.Time     `json:"created"`
+}
+
+// NewRevision returns a revision with the current content of a post, written by the editor of the post
+func NewRevision(post Post) Revision {
+	return Revision{
+		Slug:     post.Slug,
+		UserID:   post.Editor(),
+		Author:   post.Author,
+		Title:    post.Title,
+		Body:     post.Body,
+		Markdown: post.Markdown,
+		Tags:     post.Tags,
+		Created:  post.Modified,
+	}
+}
+
+// Restore returns the post with its content replaced by the content of the revision
+// The slug, author and creation date of the post are kept
+func (r Revision) Restore(post Post) Post {
+	post.Title = r.Title
+	post.Body = r.Body
+	post.Markdown = r.Markdown
+	post.Tags = r.Tags
+	return post
+}
+
+// Source returns the text the revision was written in: the Markdown, or the body for revisions written in HTML
+func (r Revision) Source() string {
+	if r.Markdown != "" {
+		return r.Markdown
+	}
+	return string(r.Body)
+}
+
+// text returns the revision as it's compared in a diff: the title and tags followed by the source
+func (r Revision) text() string {
+	return fmt.Sprintf("Title: %s\nTags: %s\n\n%s\n", r.Title, strings.Join(r.Tags, ", "), r.Source())
+}
+
+// label identifies the revision in the header of a diff
+func (r Revision) label() string {
+	return fmt.Sprintf("revision %d", r.ID)
+}
+
+// DiffRevisions returns a unified diff from one revision to another (https://www.gnu.org/software/diffutils/manual/html_node/Unified-Format.html)
+// Returns an empty string if the revisions have the same content
+func DiffRevisions(from, to Revision) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from.text()),
+		B:        difflib.SplitLines(to.text()),
+		FromFile: from.label(),
+		FromDate: from.Created.Format(time.RFC3339),
+		ToFile:   to.label(),
+		ToDate:   to.Created.Format(time.RFC3339),
+		Context:  3,
+	})
+}
@@ -0,0 +1,57 @@
+package models
+
+// The roles of the users, from the most to the least privileged
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleAuthor = "author"
+	RoleReader = "reader"
+)
+
+// Roles contains all roles, from the most to the least privileged
+var Roles = []string{RoleAdmin, RoleEditor, RoleAuthor, RoleReader}
+
+// DefaultRole is the role of newly registered users
+// Everybody could write posts before roles existed, change it to RoleReader to let new users only comment
+var DefaultRole = RoleAuthor
+
+// Permission is something a role allows a user to do
+type Permission string
+
+// The permissions which are granted to the roles
+const (
+	// PermComment allows commenting on posts
+	PermComment Permission = "comment"
+	// PermWritePosts allows writing posts, and editing, deleting and moderating the comments on one's own posts
+	PermWritePosts Permission = "write_posts"
+	// PermEditAnyPost allows editing the posts of other users and moderating their comments
+	PermEditAnyPost Permission = "edit_any_post"
+	// PermDeleteAnyPost allows deleting the posts of other users
+	PermDeleteAnyPost Permission = "delete_any_post"
+	// PermManageUsers allows managing the accounts of other users
+	PermManageUsers Permission = "manage_users"
+)
+
+// rolePermissions contains the permissions per role
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:  {PermComment, PermWritePosts, PermEditAnyPost, PermDeleteAnyPost, PermManageUsers},
+	RoleEditor: {PermComment, PermWritePosts, PermEditAnyPost},
+	RoleAuthor: {PermComment, PermWritePosts},
+	RoleReader: {PermComment},
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleHasPermission reports whether a role grants a permission
+func RoleHasPermission(role string, p Permission) bool {
+	for _, perm := range rolePermissions[role] {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// DefaultSanitizePolicy returns the policy used for post bodies unless Policy is replaced
+// It starts from the bluemonday policy for user generated content (https://github.com/microcosm-cc/bluemonday), which
+// removes scripts, styles, event handlers and URLs with other schemes than http, https and mailto. It also allows the
+// formatting used by the Markdown renderer
+func DefaultSanitizePolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// Keep the heading anchors and the language of fenced code blocks
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)).OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[a-zA-Z0-9+#_-]+$`)).OnElements("code")
+
+	// Keep the checkboxes of task lists, SanitizeHTML removes the inputs of any other type
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+
+	// Links to other sites get rel="nofollow noopener" and open in a new tab, links within the blog are left alone
+	p.RequireNoFollowOnLinks(false)
+	p.RequireNoFollowOnFullyQualifiedLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+
+	return p
+}
+
+// Policy is the sanitization policy every post body is run through
+// Replace it to change what's allowed, existing posts can be sanitized again with the sanitize command
+var Policy = DefaultSanitizePolicy()
+
+// inputTag matches the input elements in the output of bluemonday, which quotes and escapes every attribute value
+// So type="checkbox" can only appear in it as the type attribute
+var inputTag = regexp.MustCompile(`<input[^>]*>`)
+
+// SanitizeHTML removes everything Policy doesn't allow from s
+// bluemonday can't require an attribute, so inputs which aren't checkboxes are removed afterwards. They would render
+// as text fields
+func SanitizeHTML(s string) string {
+	return inputTag.ReplaceAllStringFunc(Policy.Sanitize(s), func(tag string) string {
+		if strings.Contains(tag, ` type="checkbox"`) {
+			return tag
+		}
+		return ""
+	})
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`<p onclick="x()">text</p><script>alert(1)</script>`, `<p>text</p>`},
+		{`<a href="javascript:alert(1)">link</a>`, `link`},
+		{`<a href="/local">link</a>`, `<a href="/local">link</a>`},
+		{`<a href="https://example.com/">link</a>`, `<a href="https://example.com/" rel="nofollow noopener" target="_blank">link</a>`},
+		{`<h2 id="intro">Intro</h2>`, `<h2 id="intro">Intro</h2>`},
+		{`<code class="language-go">x</code>`, `<code class="language-go">x</code>`},
+		// Only the checkboxes of task lists are kept, any other input would render as a text field
+		{`<input checked="" disabled="" type="checkbox"> done`, `<input checked="" disabled="" type="checkbox"> done`},
+		{`<input> <input type="text"> <input checked> <input disabled value="x">`, `   `},
+		{`<input checked=' type="checkbox"'>`, ``},
+	}
+
+	for _, tt := range tests {
+		if got := SanitizeHTML(tt.in); got != tt.want {
+			t.Errorf("SanitizeHTML(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
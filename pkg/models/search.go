@@ -0,0 +1,32 @@
+package models
+
+import (
+	"html"
+	"html/template"
+	"strings"
+)
+
+// Markers which delimit a match in a snippet before it's converted to HTML
+// Control characters are used because they don't appear in post text
+const (
+	SnippetMatchStart = "\x02"
+	SnippetMatchEnd   = "\x03"
+)
+
+// SearchResult is a post matching a search query
+type SearchResult struct {
+	Post Post `json:"post"`
+	// Snippet is an excerpt of the post with the matches wrapped in <mark> tags
+	Snippet template.HTML `json:"snippet"`
+	// Rank is the relevance of the result, lower is better
+	Rank float64 `json:"rank"`
+}
+
+// HighlightSnippet escapes a plain text snippet and replaces the match markers with <mark> tags
+func HighlightSnippet(snippet string) template.HTML {
+	s := html.EscapeString(snippet)
+	s = strings.Replace(s, SnippetMatchStart, "<mark>", -1)
+	s = strings.Replace(s, SnippetMatchEnd, "</mark>", -1)
+
+	return template.HTML(s)
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxSlugLength is the maximum length of a slug
+const MaxSlugLength = 80
+
+// reservedSlugs are used by other routes of the blog, a post with one of these slugs couldn't be reached
+var reservedSlugs = map[string]bool{
+	"admin":    true,
+	"api":      true,
+	"archive":  true,
+	"assets":   true,
+	"login":    true,
+	"logout":   true,
+	"new":      true,
+	"profile":  true,
+	"register": true,
+	"reset":    true,
+	"search":   true,
+	"tag":      true,
+	"verify":   true,
+}
+
+// IsReservedSlug reports whether a slug is used by another route
+func IsReservedSlug(slug string) bool {
+	return reservedSlugs[slug]
+}
+
+// transliterations contains the letters which don't decompose into an ASCII letter and a diacritic
+// Cyrillic follows the Bulgarian Streamlined System, with the letters of other languages added
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'ł': "l", 'þ': "th", 'ı': "i", 'ŋ': "ng",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ж': "zh", 'з': "z", 'и': "i", 'й': "y",
+	'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "h", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "sht", 'ъ': "a", 'ь': "y", 'ю': "yu", 'я': "ya",
+	'ё': "yo", 'ы': "y", 'э': "e", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ѝ': "i",
+}
+
+// Slugify turns a title into a slug: transliterated to ASCII, lowercased, with everything but letters and digits
+// replaced by dashes. The slug is cut at a dash to MaxSlugLength. Returns an empty string if nothing remains
+func Slugify(title string) string {
+	var b strings.Builder
+	dash := false
+
+	// Compose the letters first, so letters with a diacritic can be found in transliterations
+	for _, r := range norm.NFC.String(strings.ToLower(title)) {
+		s, ok := transliterations[r]
+		if !ok {
+			// Decompose the letter and drop the diacritics (https://blog.golang.org/normalization)
+			s = strings.Map(func(r rune) rune {
+				if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+					return r
+				}
+				return -1
+			}, norm.NFD.String(string(r)))
+		}
+
+		// Collapse everything else into a single dash
+		if s == "" {
+			if !dash && b.Len() > 0 {
+				b.WriteRune('-')
+				dash = true
+			}
+			continue
+		}
+
+		b.WriteString(s)
+		dash = false
+	}
+
+	return cutSlug(strings.TrimSuffix(b.String(), "-"), MaxSlugLength)
+}
+
+// cutSlug shortens a slug to at most max characters, at a dash if possible
+func cutSlug(slug string, max int) string {
+	if len(slug) <= max {
+		return slug
+	}
+
+	slug = slug[:max]
+	if i := strings.LastIndex(slug, "-"); i > 0 {
+		slug = slug[:i]
+	}
+	return strings.TrimSuffix(slug, "-")
+}
+
+// SlugCandidate returns the nth candidate for a slug based on base, to resolve collisions
+// The first candidate is base itself, the next ones get a suffix: base-2, base-3 and so on
+func SlugCandidate(base string, n int) string {
+	if n <= 1 {
+		return base
+	}
+
+	suffix := "-" + strconv.Itoa(n)
+	return cutSlug(base, MaxSlugLength-len(suffix)) + suffix
+}
+
+// slugRegexp matches valid slugs: lowercase letters and digits, separated by single dashes
+var slugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// ValidateSlug checks that a slug is well-formed and not reserved
+func ValidateSlug(slug string) error {
+	if slug == "" {
+		return ValidationError{"Slug", "empty"}
+	}
+	if len(slug) > MaxSlugLength {
+		return ValidationError{"Slug", "too long"}
+	}
+	if !slugRegexp.MatchString(slug) {
+		return ValidationError{"Slug", "only lowercase letters, digits and dashes are allowed"}
+	}
+	if IsReservedSlug(slug) {
+		return ValidationError{"Slug", "reserved: " + slug}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpamThreshold is the score from which a comment is considered spam
+const SpamThreshold = 1.0
+
+// CommentSubmission is a new comment together with the details of how it was submitted
+type CommentSubmission struct {
+	Comment Comment
+	// IP is the address the comment was submitted from
+	IP string
+	// Honeypot is the value of a form field which is hidden from people, only bots fill it in
+	Honeypot string
+}
+
+// sender identifies who submitted the comment: the user, or the address of an anonymous commenter
+func (s CommentSubmission) sender() string {
+	if s.Comment.UserID != 0 {
+		return fmt.Sprintf("user:%d", s.Comment.UserID)
+	}
+	if s.IP != "" {
+		return "ip:" + s.IP
+	}
+	return "email:" + strings.ToLower(s.Comment.Email)
+}
+
+// SpamScore is the result of scoring a comment, Reasons explain how the score came about
+type SpamScore struct {
+	Score   float64
+	Reasons []string
+}
+
+// Spam reports whether the score reaches SpamThreshold
+func (s SpamScore) Spam() bool {
+	return s.Score >= SpamThreshold
+}
+
+// add raises the score and records the reason
+func (s *SpamScore) add(score float64, reason string) {
+	s.Score += score
+	s.Reasons = append(s.Reasons, reason)
+}
+
+// SpamScorer scores new comments, comments scoring SpamThreshold or more are marked as spam
+// Implement it to plug in another spam filter, for example an external service
+type SpamScorer interface {
+	Score(sub CommentSubmission) SpamScore
+}
+
+// DefaultSpamWords is the blocklist of the HeuristicScorer returned by NewHeuristicScorer
+var DefaultSpamWords = []string{
+	"viagra", "cialis", "casino", "payday loan", "crypto giveaway", "buy followers", "work from home",
+	"earn money fast", "replica watches", "seo services",
+}
+
+// linkRegexp matches the start of a link in a comment
+var linkRegexp = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.`)
+
+// HeuristicScorer is the built-in SpamScorer, it scores comments with a few simple rules:
+// a filled in honeypot, too many links, blocklisted words and repeated submissions
+// It remembers the recent submissions, use a single HeuristicScorer for all comments
+type HeuristicScorer struct {
+	// MaxLinks is the number of links a comment may contain before every extra link raises its score
+	MaxLinks int
+	// Blocklist contains words and phrases which are only used by spammers, they are matched case-insensitively
+	Blocklist []string
+	// RepeatWindow is how long submissions are remembered for detecting repeats
+	RepeatWindow time.Duration
+	// MaxPerWindow is the number of comments a sender may submit within RepeatWindow, 0 disables the limit
+	MaxPerWindow int
+
+	mu     sync.Mutex
+	recent []recentSubmission
+}
+
+// recentSubmission is remembered by the HeuristicScorer to detect repeated submissions
+type recentSubmission struct {
+	at          time.Time
+	sender      string
+	fingerprint [sha256.Size]byte
+}
+
+// NewHeuristicScorer returns a HeuristicScorer with the default rules
+func NewHeuristicScorer() *HeuristicScorer {
+	return &HeuristicScorer{
+		MaxLinks:     2,
+		Blocklist:    DefaultSpamWords,
+		RepeatWindow: 10 * time.Minute,
+		MaxPerWindow: 5,
+	}
+}
+
+// Score scores a comment and remembers it for detecting repeated submissions
+func (h *HeuristicScorer) Score(sub CommentSubmission) SpamScore {
+	score := SpamScore{}
+
+	// People don't see the honeypot field, so anyone filling it in is a bot
+	if sub.Honeypot != "" {
+		score.add(SpamThreshold, "honeypot filled in")
+	}
+
+	if n := len(linkRegexp.FindAllStringIndex(sub.Comment.Body, -1)); n > h.MaxLinks {
+		score.add(0.3*float64(n-h.MaxLinks), fmt.Sprintf("%d links", n))
+	}
+
+	text := strings.ToLower(sub.Comment.Name + " " + sub.Comment.Body)
+	for _, word := range h.Blocklist {
+		if word != "" && strings.Contains(text, strings.ToLower(word)) {
+			score.add(0.5, "blocklisted: "+word)
+		}
+	}
+
+	// The same comment is recognized regardless of case and whitespace
+	fingerprint := sha256.Sum256([]byte(strings.Join(strings.Fields(strings.ToLower(sub.Comment.Body)), " ")))
+	sender := sub.sender()
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Forget the submissions which are outside of the window
+	recent := h.recent[:0]
+	for _, r := range h.recent {
+		if now.Sub(r.at) < h.RepeatWindow {
+			recent = append(recent, r)
+		}
+	}
+	h.recent = recent
+
+	repeats, sent := 0, 0
+	for _, r := range h.recent {
+		if r.fingerprint == fingerprint {
+			repeats++
+		}
+		if r.sender == sender {
+			sent++
+		}
+	}
+	// Every repeat and every comment over the limit makes spam more likely
+	if repeats > 0 {
+		score.add(0.4*float64(repeats), fmt.Sprintf("repeated %d times", repeats))
+	}
+	if excess := sent + 1 - h.MaxPerWindow; h.MaxPerWindow > 0 && excess > 0 {
+		score.add(0.5*float64(excess), fmt.Sprintf("%d comments within %v", sent+1, h.RepeatWindow))
+	}
+
+	h.recent = append(h.recent, recentSubmission{at: now, sender: sender, fingerprint: fingerprint})
+
+	return score
+}
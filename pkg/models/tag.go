@@ -0,0 +1,60 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// MaxTagLength is the maximum length of a normalized tag name
+const MaxTagLength = 32
+
+// Tag is a tag with the number of posts using it
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTag returns the canonical form of a tag name: lowercased, with spaces replaced by dashes and only
+// letters, digits and dashes left. Returns an empty string if nothing remains
+func NormalizeTag(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			dash = false
+		case unicode.IsSpace(r) || r == '-' || r == '_':
+			// Collapse runs of separators into a single dash
+			if !dash && b.Len() > 0 {
+				b.WriteRune('-')
+				dash = true
+			}
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// NormalizeTags normalizes a list of tag names, removes empty names and duplicates and sorts the result
+func NormalizeTags(names []string) []string {
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, name := range names {
+		tag := NormalizeTag(name)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return tags
+}
+
+// ParseTags parses a comma separated list of tag names, as entered in a form
+func ParseTags(s string) []string {
+	return NormalizeTags(strings.Split(s, ","))
+}
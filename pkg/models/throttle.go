@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// The kinds of login throttles, failed logins are counted per username and per IP address
+const (
+	ThrottleUsername = "username"
+	ThrottleIP       = "ip"
+)
+
+// LoginThrottle counts the failed logins for a username or an IP address, and locks out further logins for a while
+// when there were too many
+type LoginThrottle struct {
+	// Kind is ThrottleUsername or ThrottleIP
+	Kind string `json:"kind"`
+	// Value is the username in lower case, or the IP address
+	Value       string    `json:"value"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// LockedUntil is when logins are allowed again, it's in the past when they are allowed
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Locked reports whether logins are locked out at the provided time
+func (t LoginThrottle) Locked(now time.Time) bool {
+	return t.LockedUntil.After(now)
+}
+
+// RetryAfter returns how long logins are still locked out at the provided time, 0 if they are allowed
+func (t LoginThrottle) RetryAfter(now time.Time) time.Duration {
+	if !t.Locked(now) {
+		return 0
+	}
+	return t.LockedUntil.Sub(now)
+}
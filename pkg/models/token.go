@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// RefreshToken is a refresh token of the API, which is exchanged for a new access token and a new refresh token
+// Only the hash of the token is stored. The tokens which replaced each other share a family, so all of them can be
+// revoked at once when a token which was replaced already is used again
+type RefreshToken struct {
+	TokenHash string
+	UserID    int64
+	Family    string
+	Created   time.Time
+	Expires   time.Time
+	// Used is set once the token was exchanged, only the newest token of a family isn't used
+	Used bool
+}
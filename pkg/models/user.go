@@ -1,11 +1,44 @@
 package models
 
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+)
+
+// Limits for the username
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+)
+
+// usernameRegexp matches the allowed usernames: ASCII letters, digits, dots, dashes and underscores, starting and ending
+// with a letter or digit. Usernames appear in URLs, and other alphabets would allow names which look like another user
+var usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9._-]*[a-zA-Z0-9])?$`)
+
 // User is a user of the blog system
 type User struct {
 	ID       int64  `json:"id"`
 	Username string `json:"username"`
 	Name     string `json:"name"`
-	Password string `json:"password"`
+	// Email is optional, it's needed to receive password reset links and to get verified
+	Email string `json:"email"`
+	// EmailVerified is set when the user opened the verification link sent to Email, or when an admin verified it
+	// Users from before email verification existed are verified without an email address. Changing Email clears it
+	EmailVerified bool `json:"email_verified"`
+	// Password is the hash of the password, it's never sent to clients
+	Password string `json:"-"`
+	// Role is one of Roles, it decides the permissions of the user
+	Role string `json:"role"`
+	// Disabled users can't log in, and their sessions and tokens are rejected
+	Disabled bool `json:"disabled"`
+	// PasswordReset is set when an admin forces the user to choose a new password at the next login
+	PasswordReset bool `json:"password_reset"`
+	// TOTPSecret is the secret for the codes of the authenticator app, it's never sent to clients
+	// It's set before TOTPEnabled, while the user hasn't confirmed the enrollment with a code yet
+	TOTPSecret string `json:"-"`
+	// TOTPEnabled users have to enter a code of their authenticator app or a recovery code after their password
+	TOTPEnabled bool `json:"totp_enabled"`
 }
 
 // Validate will validate a user
@@ -14,5 +47,70 @@ func (u User) Validate() error {
 		return ValidationError{"Username", "empty"}
 	}
 
+	// Usernames never change, so accounts created before these rules existed are left alone
+	if u.ID == 0 {
+		if len(u.Username) < MinUsernameLength || len(u.Username) > MaxUsernameLength {
+			return ValidationError{"Username", fmt.Sprintf("has to be %d to %d characters", MinUsernameLength, MaxUsernameLength)}
+		}
+		if !usernameRegexp.MatchString(u.Username) {
+			return ValidationError{"Username", "can only contain letters, digits, dots, dashes and underscores"}
+		}
+	}
+	// The email address has to be a bare address, without a name
+	if u.Email != "" {
+		if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email {
+			return ValidationError{"Email", "invalid value"}
+		}
+	}
+
+	if u.Role != "" && !ValidRole(u.Role) {
+		return ValidationError{"Role", "invalid value"}
+	}
+
 	return nil
 }
+
+// Active reports whether the user may use the blog while logged in, which isn't the case for disabled users and
+// for users who have to choose a new password first
+func (u User) Active() bool {
+	return u.ID != 0 && !u.Disabled && !u.PasswordReset
+}
+
+// Can reports whether the role of the user grants a permission
+func (u User) Can(p Permission) bool {
+	return RoleHasPermission(u.Role, p)
+}
+
+// CanEditPost reports whether the user is allowed to edit a post and moderate its comments
+// Authors can only edit their own posts, editors and admins can edit all posts
+func (u User) CanEditPost(post Post) bool {
+	if u.ID == 0 {
+		return false
+	}
+	return u.Can(PermEditAnyPost) || (u.ID == post.UserID && u.Can(PermWritePosts))
+}
+
+// CanDeletePost reports whether the user is allowed to delete a post
+// Authors and editors can only delete their own posts, admins can delete all posts
+func (u User) CanDeletePost(post Post) bool {
+	if u.ID == 0 {
+		return false
+	}
+	return u.Can(PermDeleteAnyPost) || (u.ID == post.UserID && u.Can(PermWritePosts))
+}
+
+// CanPublish reports whether the user may publish posts, which requires the role to allow writing posts and a verified
+// email address. Users who can't publish yet can still save drafts
+// EmailVerified is checked on its own, because the users from before email verification are verified without an email
+// address, and changing the address clears it anyway
+func (u User) CanPublish() bool {
+	return u.Can(PermWritePosts) && u.EmailVerified
+}
+
+// Viewer returns the viewer to read posts as: ViewAll for users who can edit all posts, otherwise the ID of the user
+func (u User) Viewer() int64 {
+	if u.ID != 0 && u.Can(PermEditAnyPost) {
+		return ViewAll
+	}
+	return u.ID
+}
@@ -3,12 +3,17 @@ package server
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/golangbg/web-api-development-demo/pkg/database"
 	"github.com/golangbg/web-api-development-demo/pkg/models"
 )
 
@@ -39,8 +44,8 @@ type postResponse struct {
 	Post  models.Post `json:"post"`
 }
 
-// postCreateUpdateAPIHandler creates or updates a single post
-func (s *Server) postCreateUpdateAPIHandler(w http.ResponseWriter, r *http.Request) {
+// postCreateAPIHandler creates a single post
+func (s *Server) postCreateAPIHandler(w http.ResponseWriter, r *http.Request) {
 	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
 	req := models.Post{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -49,7 +54,7 @@ func (s *Server) postCreateUpdateAPIHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Get the active user
-	au, err := getUserFromToken(r)
+	au, err := s.getUserFromToken(r)
 	if err != nil {
 		answer(w, http.StatusBadRequest, err.Error())
 		return
@@ -66,6 +71,25 @@ func (s *Server) postCreateUpdateAPIHandler(w http.ResponseWriter, r *http.Reque
 	// Set the user ID, because the request doesn't contain this field
 	req.UserID = user.ID
 
+	// Posts without a status are published, which requires a verified email address
+	if err := checkPublish(user, req.Status, ""); err != nil {
+		answer(w, http.StatusForbidden, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Use the requested slug, or generate one from the title
+	req.Slug, err = s.newPostSlug(req.Slug, req.Title)
+	if err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Render the Markdown into the body, if the post is written in Markdown
+	if err := req.Render(); err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
 	// Perform validation
 	if err := req.Validate(); err != nil {
 		// Validation failed
@@ -73,9 +97,14 @@ func (s *Server) postCreateUpdateAPIHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Save the post
-	post, err := s.db.SavePost(req)
+	// Create the post
+	post, err := s.db.CreatePost(req)
 	if err != nil {
+		if err == database.ErrPostExists {
+			answer(w, http.StatusConflict, postResponse{Error: err.Error()})
+			return
+		}
+
 		// Saving went wrong, reply with an error
 		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
 		return
@@ -84,14 +113,160 @@ func (s *Server) postCreateUpdateAPIHandler(w http.ResponseWriter, r *http.Reque
 	answer(w, http.StatusCreated, postResponse{Post: post})
 }
 
+// postUpdateAPIHandler updates a single post
+// Authors are allowed to update their own posts, editors and admins all posts
+func (s *Server) postUpdateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := models.Post{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Get the active user
+	au, err := s.getUserFromToken(r)
+	if err != nil {
+		answer(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Get the user details
+	user, err := s.db.GetUserByUsername(au)
+	if err != nil {
+		// We didn't get a valid user from the db, so we'll deny access
+		answer(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Get the existing post from the DB
+	existing, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, postResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Check if the active user is allowed to edit the post
+	if !user.CanEditPost(existing) {
+		answer(w, http.StatusForbidden, postResponse{Error: "only the author or an editor can update this post"})
+		return
+	}
+
+	// A new slug in the request renames the post, the author and creation date are taken from the existing post
+	if req.Slug, err = editedPostSlug(existing.Slug, req.Slug); err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+	req.UserID = existing.UserID
+	req.Author = existing.Author
+	req.Created = existing.Created
+	req.EditorID = user.ID
+
+	// The publication state is only changed when it's provided
+	if req.Status == "" {
+		req.Status = existing.Status
+	}
+	if req.PublishAt.IsZero() && req.Status == existing.Status {
+		req.PublishAt = existing.PublishAt
+	}
+	if err := checkPublish(user, req.Status, existing.Status); err != nil {
+		answer(w, http.StatusForbidden, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Render the Markdown into the body, if the post is written in Markdown
+	if err := req.Render(); err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Perform validation
+	if err := req.Validate(); err != nil {
+		// Validation failed
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Update the post, a new slug renames it at the same time. The post is left untouched if the new slug is taken
+	post, err := s.db.UpdatePost(existing.Slug, req)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, postResponse{Error: err.Error()})
+			return
+		}
+		if err == database.ErrPostExists {
+			answer(w, http.StatusConflict, postResponse{Error: err.Error()})
+			return
+		}
+
+		// Saving went wrong, reply with an error
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, postResponse{Post: post})
+}
+
+// Formats a post body can be fetched in, through the format query parameter
+const (
+	formatHTML     = "html"
+	formatMarkdown = "markdown"
+)
+
+// formatPost leaves only the representation of the body the client asked for
+// An empty format returns both the HTML and, if the post was written in Markdown, the Markdown
+func formatPost(post models.Post, format string) models.Post {
+	switch format {
+	case formatHTML:
+		post.Markdown = ""
+	case formatMarkdown:
+		// HTML is valid Markdown, so posts written in HTML can be fetched as Markdown too
+		post.Markdown = post.Source()
+		post.Body = ""
+	}
+	return post
+}
+
+// getFormat returns the format query parameter, or an error if the format is unknown
+func getFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", formatHTML, formatMarkdown:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid format %q, use %s or %s", format, formatHTML, formatMarkdown)
+	}
+}
+
 // postGetAPIHandler gets a single post from the database
+// The body is returned in the format requested through the format query parameter
 func (s *Server) postGetAPIHandler(w http.ResponseWriter, r *http.Request) {
 	args := mux.Vars(r)
 
-	// Get the post from the DB
-	post, err := s.db.GetPostBySlug(args["slug"])
+	format, err := getFormat(r)
+	if err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Get the post from the DB, unpublished posts are only returned to their author
+	viewer := s.getTokenUser(r).Viewer()
+	post, err := s.db.GetPostBySlug(args["slug"], viewer)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			// The post may have been renamed, then its old URL redirects permanently
+			if slug, ok := s.movedPostSlug(args["slug"], viewer); ok {
+				u := *r.URL
+				u.Path = "/api/post/" + slug
+				http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+				return
+			}
+
 			answer(w, http.StatusNotFound, postResponse{Error: err.Error()})
 			return
 		}
@@ -100,19 +275,191 @@ func (s *Server) postGetAPIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer(w, http.StatusOK, postResponse{Post: post})
+	answer(w, http.StatusOK, postResponse{Post: formatPost(post, format)})
 }
 
 // postsResponse can be used to send a response with posts items
 type postsResponse struct {
-	Error string        `json:"error"`
-	Posts []models.Post `json:"posts"`
+	Error      string        `json:"error"`
+	Posts      []models.Post `json:"posts"`
+	NextCursor string        `json:"next_cursor,omitempty"`
 }
 
-// postGetAPIHandler gets all posts from the database
+// Limits for the number of posts per page
+const (
+	defaultPostsLimit = 20
+	maxPostsLimit     = 100
+)
+
+// postsGetAPIHandler gets a page of posts from the database
+// The page is controlled by the limit, cursor, sort and tag query parameters, the body by the format query parameter
 func (s *Server) postsGetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	// Parse the query parameters
+	query := database.PostQuery{Limit: defaultPostsLimit, Cursor: params.Get("cursor")}
+	if l := params.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxPostsLimit {
+			answer(w, http.StatusBadRequest, postsResponse{Error: fmt.Sprintf("limit should be between 1 and %d", maxPostsLimit)})
+			return
+		}
+		query.Limit = limit
+	}
+
+	sort, err := database.ParsePostSort(params.Get("sort"))
+	if err != nil {
+		answer(w, http.StatusBadRequest, postsResponse{Error: err.Error()})
+		return
+	}
+	query.Sort = sort
+
+	format, err := getFormat(r)
+	if err != nil {
+		answer(w, http.StatusBadRequest, postsResponse{Error: err.Error()})
+		return
+	}
+
+	// Filter on a tag if one is requested
+	if tag := params.Get("tag"); tag != "" {
+		query.Filter.Tag = models.NormalizeTag(tag)
+	}
+
+	// Authors also get their own unpublished posts
+	query.Filter.Viewer = s.getTokenUser(r).Viewer()
+
 	// Get the posts from the DB
-	posts, err := s.db.GetAllPosts()
+	page, err := s.db.GetPosts(query)
+	if err != nil {
+		answer(w, http.StatusBadRequest, postsResponse{Error: err.Error()})
+		return
+	}
+
+	// Add Link headers, so clients can navigate without building URLs themselves (https://tools.ietf.org/html/rfc8288)
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(r, query, ""))}
+	if page.NextCursor != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, query, page.NextCursor)))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	for i := range page.Posts {
+		page.Posts[i] = formatPost(page.Posts[i], format)
+	}
+
+	answer(w, http.StatusOK, postsResponse{Posts: page.Posts, NextCursor: page.NextCursor})
+}
+
+// pageURL returns the URL of the current request for the page starting at the provided cursor
+func pageURL(r *http.Request, query database.PostQuery, cursor string) string {
+	params := r.URL.Query()
+	params.Set("limit", strconv.Itoa(query.Limit))
+	params.Set("sort", query.Sort.String())
+	params.Del("cursor")
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+
+	u := *r.URL
+	u.RawQuery = params.Encode()
+	return u.RequestURI()
+}
+
+// tagsResponse can be used to send a response with tags
+type tagsResponse struct {
+	Error string       `json:"error"`
+	Tags  []models.Tag `json:"tags"`
+}
+
+// tagsGetAPIHandler gets all tags with the number of posts using them
+func (s *Server) tagsGetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := s.db.GetTags()
+	if err != nil {
+		answer(w, http.StatusBadRequest, tagsResponse{Error: err.Error()})
+		return
+	}
+
+	// Always answer with a list, also when there are no tags
+	if tags == nil {
+		tags = []models.Tag{}
+	}
+
+	answer(w, http.StatusOK, tagsResponse{Tags: tags})
+}
+
+// searchResponse can be used to send a response with search results
+type searchResponse struct {
+	Error   string                `json:"error"`
+	Query   string                `json:"query"`
+	Results []models.SearchResult `json:"results"`
+}
+
+// searchAPIHandler searches the posts, the query is passed through the q query parameter
+// The number of results is controlled by the limit and offset query parameters
+func (s *Server) searchAPIHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		answer(w, http.StatusBadRequest, searchResponse{Error: "q is empty"})
+		return
+	}
+
+	limit, offset := defaultPostsLimit, 0
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxPostsLimit {
+			answer(w, http.StatusBadRequest, searchResponse{Error: fmt.Sprintf("limit should be between 1 and %d", maxPostsLimit)})
+			return
+		}
+	}
+	if o := params.Get("offset"); o != "" {
+		var err error
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			answer(w, http.StatusBadRequest, searchResponse{Error: "invalid offset"})
+			return
+		}
+	}
+
+	results, err := s.db.SearchPosts(q, limit, offset)
+	if err == database.ErrSearchUnavailable {
+		answer(w, http.StatusNotImplemented, searchResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		answer(w, http.StatusBadRequest, searchResponse{Error: err.Error()})
+		return
+	}
+
+	// Always answer with a list, also when nothing was found
+	if results == nil {
+		results = []models.SearchResult{}
+	}
+
+	answer(w, http.StatusOK, searchResponse{Query: q, Results: results})
+}
+
+// postDeleteAPIHandler deletes a single post
+// Authors are allowed to delete their own posts, admins all posts
+func (s *Server) postDeleteAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Get the active user
+	au, err := s.getUserFromToken(r)
+	if err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Get the user details
+	user, err := s.db.GetUserByUsername(au)
+	if err != nil {
+		// We didn't get a valid user from the db, so we'll deny access
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Get the post from the DB
+	post, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
 	if err != nil {
 		if err == sql.ErrNoRows {
 			answer(w, http.StatusNotFound, postResponse{Error: err.Error()})
@@ -123,52 +470,986 @@ func (s *Server) postsGetAPIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer(w, http.StatusOK, postsResponse{Posts: posts})
+	// Check if the active user is allowed to delete the post
+	if !user.CanDeletePost(post) {
+		answer(w, http.StatusForbidden, postResponse{Error: "only the author or an admin can delete this post"})
+		return
+	}
+
+	// Delete the post
+	if err := s.db.DeletePost(post.Slug); err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, postResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, postResponse{Post: post})
 }
 
-type authenticationRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+// getEditablePost gets a post which the user authenticated with the token is allowed to edit, and that user
+// Returns the HTTP status to answer with when the post can't be returned
+func (s *Server) getEditablePost(r *http.Request, slug string) (models.Post, models.User, int, error) {
+	// Get the active user
+	au, err := s.getUserFromToken(r)
+	if err != nil {
+		return models.Post{}, models.User{}, http.StatusBadRequest, err
+	}
+
+	// Get the user details
+	user, err := s.db.GetUserByUsername(au)
+	if err != nil {
+		return models.Post{}, models.User{}, http.StatusBadRequest, err
+	}
+
+	// Get the post from the DB
+	post, err := s.db.GetPostBySlug(slug, user.Viewer())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.Post{}, user, http.StatusNotFound, err
+		}
+		return models.Post{}, user, http.StatusBadRequest, err
+	}
+
+	// Check if the active user is allowed to edit the post
+	if !user.CanEditPost(post) {
+		return models.Post{}, user, http.StatusForbidden, fmt.Errorf("only the author or an editor can manage this post")
+	}
+
+	return post, user, http.StatusOK, nil
 }
 
-type authenticationResponse struct {
-	Error string `json:"error"`
-	Token string `json:"token"`
+// revisionsResponse can be used to send a response with the revisions of a post
+type revisionsResponse struct {
+	Error     string            `json:"error"`
+	Revisions []models.Revision `json:"revisions"`
 }
 
-func (s *Server) userAuthenticateAPIHandler(w http.ResponseWriter, r *http.Request) {
-	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
-	req := authenticationRequest{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+// postRevisionsAPIHandler gets all revisions of a post, newest first
+// Only the users who are allowed to edit the post can see its history
+func (s *Server) postRevisionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	post, _, status, err := s.getEditablePost(r, args["slug"])
+	if err != nil {
+		answer(w, status, revisionsResponse{Error: err.Error()})
 		return
 	}
 
-	// Get the user from the database
-	user, err := s.db.GetUserByUsername(req.Username)
+	revisions, err := s.db.GetRevisions(post.Slug)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			answer(w, http.StatusBadRequest, authenticationResponse{Error: "login failed"})
-			return
-		}
+		answer(w, http.StatusBadRequest, revisionsResponse{Error: err.Error()})
+		return
+	}
 
-		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+	// Always answer with a list, also for posts saved before revisions existed
+	if revisions == nil {
+		revisions = []models.Revision{}
+	}
+
+	answer(w, http.StatusOK, revisionsResponse{Revisions: revisions})
+}
+
+// revisionResponse can be used to send a response with a single revision
+type revisionResponse struct {
+	Error    string          `json:"error"`
+	Revision models.Revision `json:"revision"`
+}
+
+// postRevisionAPIHandler gets a single revision of a post
+// Only the users who are allowed to edit the post can see its history
+func (s *Server) postRevisionAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	post, _, status, err := s.getEditablePost(r, args["slug"])
+	if err != nil {
+		answer(w, status, revisionResponse{Error: err.Error()})
 		return
 	}
 
-	// Check if the password matches
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		// Password doesn't match
-		answer(w, http.StatusBadRequest, authenticationResponse{Error: "login failed"})
+	// The route only matches digits, so only an out of range ID fails here
+	id, err := strconv.ParseInt(args["id"], 10, 64)
+	if err != nil {
+		answer(w, http.StatusBadRequest, revisionResponse{Error: "invalid revision"})
 		return
 	}
 
-	// Create a jwt token which is valid for a month
-	token, err := CreateToken(map[string]interface{}{"activeUser": user.Username}, time.Now().AddDate(0, 1, 0).Unix())
+	rev, err := s.db.GetRevision(post.Slug, id)
 	if err != nil {
-		answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, revisionResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusBadRequest, revisionResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, revisionResponse{Revision: rev})
+}
+
+// diffResponse can be used to send a response with the differences between two revisions
+type diffResponse struct {
+	Error string `json:"error"`
+	From  int64  `json:"from"`
+	To    int64  `json:"to"`
+	Diff  string `json:"diff"`
+}
+
+// selectRevisions picks the revisions to compare from the revisions of a post, which are ordered newest first
+// An ID of 0 selects the default: the newest revision for to, the revision before to for from
+func selectRevisions(revisions []models.Revision, fromID, toID int64) (from, to models.Revision, err error) {
+	if len(revisions) == 0 {
+		return from, to, fmt.Errorf("the post has no revisions")
+	}
+
+	toIndex := 0
+	if toID != 0 {
+		toIndex = -1
+		for i, rev := range revisions {
+			if rev.ID == toID {
+				toIndex = i
+			}
+		}
+		if toIndex < 0 {
+			return from, to, fmt.Errorf("unknown revision %d", toID)
+		}
+	}
+	to = revisions[toIndex]
+
+	if fromID == 0 {
+		if toIndex == len(revisions)-1 {
+			return from, to, fmt.Errorf("revision %d is the first revision", to.ID)
+		}
+		return revisions[toIndex+1], to, nil
+	}
+
+	for _, rev := range revisions {
+		if rev.ID == fromID {
+			return rev, to, nil
+		}
+	}
+	return from, to, fmt.Errorf("unknown revision %d", fromID)
+}
+
+// parseRevisionID parses an optional revision ID from a query parameter, an empty parameter returns 0
+func parseRevisionID(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid revision %q", s)
+	}
+	return id, nil
+}
+
+// postDiffAPIHandler answers with a unified diff between two revisions of a post
+// The revisions are selected with the from and to query parameters, by default the newest revision is compared with the one before it
+// Only the users who are allowed to edit the post can see its history
+func (s *Server) postDiffAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+	params := r.URL.Query()
+
+	fromID, err := parseRevisionID(params.Get("from"))
+	if err != nil {
+		answer(w, http.StatusBadRequest, diffResponse{Error: err.Error()})
+		return
+	}
+	toID, err := parseRevisionID(params.Get("to"))
+	if err != nil {
+		answer(w, http.StatusBadRequest, diffResponse{Error: err.Error()})
+		return
+	}
+
+	post, _, status, err := s.getEditablePost(r, args["slug"])
+	if err != nil {
+		answer(w, status, diffResponse{Error: err.Error()})
+		return
+	}
+
+	revisions, err := s.db.GetRevisions(post.Slug)
+	if err != nil {
+		answer(w, http.StatusBadRequest, diffResponse{Error: err.Error()})
+		return
+	}
+
+	from, to, err := selectRevisions(revisions, fromID, toID)
+	if err != nil {
+		answer(w, http.StatusNotFound, diffResponse{Error: err.Error()})
+		return
+	}
+
+	diff, err := models.DiffRevisions(from, to)
+	if err != nil {
+		answer(w, http.StatusBadRequest, diffResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, diffResponse{From: from.ID, To: to.ID, Diff: diff})
+}
+
+// postRestoreAPIHandler restores a post to the content of one of its revisions
+// Restoring is saved as a new revision, so it can be undone by restoring an other revision
+// Only the users who are allowed to edit the post can restore it
+func (s *Server) postRestoreAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	existing, user, status, err := s.getEditablePost(r, args["slug"])
+	if err != nil {
+		answer(w, status, postResponse{Error: err.Error()})
+		return
+	}
+
+	// The route only matches digits, so only an out of range ID fails here
+	id, err := strconv.ParseInt(args["id"], 10, 64)
+	if err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: "invalid revision"})
+		return
+	}
+
+	rev, err := s.db.GetRevision(existing.Slug, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, postResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Render the restored Markdown, the sanitization policy may have changed since the revision was saved
+	post := rev.Restore(existing)
+	post.EditorID = user.ID
+	if err := post.Render(); err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Perform validation
+	if err := post.Validate(); err != nil {
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	post, err = s.db.UpdatePost(post.Slug, post)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, postResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, postResponse{Post: post})
+}
+
+// commentsResponse can be used to send a response with the comments on a post
+type commentsResponse struct {
+	Error    string           `json:"error"`
+	Comments []models.Comment `json:"comments"`
+}
+
+// postCommentsAPIHandler gets the comments on a post, threaded: replies are nested in the comment they reply to
+// Everybody gets the approved comments, users who can edit the post can request the comments in another state with
+// ?status=
+func (s *Server) postCommentsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.CommentApproved
+	}
+	if !models.ValidCommentStatus(status) {
+		answer(w, http.StatusBadRequest, commentsResponse{Error: "invalid status"})
+		return
+	}
+
+	if status == models.CommentApproved {
+		// Approved comments are shown for posts the viewer can read
+		if _, err := s.db.GetPostBySlug(args["slug"], s.getTokenUser(r).Viewer()); err != nil {
+			if err == sql.ErrNoRows {
+				answer(w, http.StatusNotFound, commentsResponse{Error: err.Error()})
+				return
+			}
+
+			answer(w, http.StatusBadRequest, commentsResponse{Error: err.Error()})
+			return
+		}
+	} else {
+		// The moderation queue is only shown to the users who can edit the post
+		if _, _, status, err := s.getEditablePost(r, args["slug"]); err != nil {
+			answer(w, status, commentsResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	comments, err := s.db.GetComments(args["slug"], status)
+	if err != nil {
+		answer(w, http.StatusBadRequest, commentsResponse{Error: err.Error()})
+		return
+	}
+
+	// The spam score is only shown to moderators, in the moderation queue
+	if status == models.CommentApproved {
+		for i := range comments {
+			comments[i].SpamScore = 0
+		}
+	}
+
+	answer(w, http.StatusOK, commentsResponse{Comments: models.ThreadComments(comments)})
+}
+
+// commentRequest contains the fields of a new comment
+// Name and email are only required without a token, they're ignored for authenticated users
+// Website is a honeypot, clients should leave it empty
+type commentRequest struct {
+	ParentID int64  `json:"parent_id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Body     string `json:"body"`
+	Website  string `json:"website"`
+}
+
+// commentResponse can be used to send a response with a single comment
+type commentResponse struct {
+	Error   string         `json:"error"`
+	Comment models.Comment `json:"comment"`
+}
+
+// postCommentCreateAPIHandler adds a comment to a post, the comment waits for moderation unless it's approved right away
+// Anyone can comment, with a token the comment is linked to the authenticated user
+func (s *Server) postCommentCreateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := commentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, commentResponse{Error: err.Error()})
+		return
+	}
+
+	// A token is optional, but an invalid one shouldn't silently turn the comment into an anonymous one
+	user := s.getTokenUser(r)
+	if user.ID == 0 && r.Header.Get("Authorization") != "" {
+		answer(w, http.StatusUnauthorized, commentResponse{Error: "invalid token"})
+		return
+	}
+
+	sub := models.CommentSubmission{
+		Comment: models.Comment{
+			Slug:     args["slug"],
+			ParentID: req.ParentID,
+			Name:     req.Name,
+			Email:    req.Email,
+			Body:     req.Body,
+		},
+		IP:       s.remoteIP(r),
+		Honeypot: req.Website,
+	}
+	comment, status, err := s.addComment(sub, user)
+	if err != nil {
+		answer(w, status, commentResponse{Error: err.Error()})
+		return
+	}
+
+	// The spam score is only shown to moderators
+	comment.SpamScore = 0
+	answer(w, status, commentResponse{Comment: comment})
+}
+
+// postCommentModerateAPIHandler approves or rejects a comment, or marks it as spam
+// Only the users who are allowed to edit the post can moderate its comments
+func (s *Server) postCommentModerateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	post, _, status, err := s.getEditablePost(r, args["slug"])
+	if err != nil {
+		answer(w, status, commentResponse{Error: err.Error()})
+		return
+	}
+
+	// The route only matches digits, so only an out of range ID fails here
+	id, err := strconv.ParseInt(args["id"], 10, 64)
+	if err != nil {
+		answer(w, http.StatusBadRequest, commentResponse{Error: "invalid comment"})
+		return
+	}
+
+	// The route only matches known actions
+	comment, err := s.db.SetCommentStatus(post.Slug, id, models.CommentActions[args["action"]])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, commentResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusBadRequest, commentResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, commentResponse{Comment: comment})
+}
+
+type authenticationRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// NewPassword is required when an admin forced a password reset, it replaces the password
+	NewPassword string `json:"new_password"`
+}
+
+type authenticationResponse struct {
+	Error string `json:"error"`
+	// Token is the access token, which is sent in the Authorization header
+	Token string `json:"token"`
+	// RefreshToken is exchanged for new tokens at /api/auth/refresh, it can be used once
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// ExpiresIn is the number of seconds the access token can be used
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	// MFARequired is set when the password was correct but the user has to send a second factor to /api/auth/mfa,
+	// together with the Challenge
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	Challenge   string `json:"challenge,omitempty"`
+}
+
+func (s *Server) userAuthenticateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := authenticationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	// Refuse logins while the username or the address is locked out after too many failed logins
+	if s.apiLoginLockedOut(w, r, req.Username) {
+		return
+	}
+
+	// Get the user from the database
+	user, err := s.db.GetUserByUsername(req.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Unknown usernames count too, so guessing them gets slow as well
+			s.loginFailed(req.Username, s.remoteIP(r))
+			answer(w, http.StatusBadRequest, authenticationResponse{Error: "login failed"})
+			return
+		}
+
+		answer(w, http.StatusBadRequest, postResponse{Error: err.Error()})
+		return
+	}
+
+	// Check if the password matches
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		// Password doesn't match
+		s.loginFailed(req.Username, s.remoteIP(r))
+		answer(w, http.StatusBadRequest, authenticationResponse{Error: "login failed"})
+		return
+	}
+
+	// Disabled users can't log in
+	if user.Disabled {
+		answer(w, http.StatusForbidden, authenticationResponse{Error: inactiveReason(user)})
+		return
+	}
+
+	// Users with two-factor authentication get a challenge, which is exchanged for a token with the second factor
+	if user.TOTPEnabled {
+		challenge, err := s.createMFAChallenge(user)
+		if err != nil {
+			answer(w, http.StatusInternalServerError, authenticationResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusAccepted, authenticationResponse{MFARequired: true, Challenge: challenge})
+		return
+	}
+
+	s.completeAPILogin(w, user, req.NewPassword)
+}
+
+// mfaRequest completes a login of a user with two-factor authentication
+type mfaRequest struct {
+	// Challenge is the challenge /api/auth answered with
+	Challenge string `json:"challenge"`
+	// Code is a code of the authenticator app or a recovery code
+	Code string `json:"code"`
+	// NewPassword is required when an admin forced a password reset, it replaces the password
+	NewPassword string `json:"new_password"`
+}
+
+// userMFAAPIHandler exchanges a challenge and the second factor for a token
+func (s *Server) userMFAAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := mfaRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	username, err := s.parseMFAChallenge(req.Challenge)
+	if err != nil {
+		answer(w, http.StatusUnauthorized, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	// Wrong codes count as failed logins, the password alone mustn't allow guessing the second factor
+	if s.apiLoginLockedOut(w, r, username) {
+		return
+	}
+
+	// The account may have been changed since the password was checked
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusUnauthorized, authenticationResponse{Error: "login failed"})
+			return
+		}
+
+		answer(w, http.StatusInternalServerError, authenticationResponse{Error: err.Error()})
+		return
+	}
+	if user.Disabled {
+		answer(w, http.StatusForbidden, authenticationResponse{Error: inactiveReason(user)})
+		return
+	}
+
+	// Check a required new password first, so the code isn't used up by a request which fails anyway
+	if user.PasswordReset {
+		if req.NewPassword == "" {
+			answer(w, http.StatusForbidden, authenticationResponse{Error: "password reset required, send a new_password"})
+			return
+		}
+		if err := models.ValidatePassword(req.NewPassword, user.Username); err != nil {
+			answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	if user.TOTPEnabled {
+		if err := s.checkSecondFactor(user, req.Code); err != nil {
+			if err == errInvalidCode || err == database.ErrTOTPCodeUsed {
+				s.loginFailed(user.Username, s.remoteIP(r))
+				answer(w, http.StatusUnauthorized, authenticationResponse{Error: err.Error()})
+				return
+			}
+
+			answer(w, http.StatusInternalServerError, authenticationResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	s.completeAPILogin(w, user, req.NewPassword)
+}
+
+// completeAPILogin answers with a token for a user who passed all authentication steps
+func (s *Server) completeAPILogin(w http.ResponseWriter, user models.User, newPassword string) {
+	var err error
+
+	// The user knew the password and the second factor, so the failed logins before were probably typos
+	s.loginSucceeded(user.Username)
+
+	// Users whose password was reset by an admin have to send a new password along
+	if user.PasswordReset {
+		if newPassword == "" {
+			answer(w, http.StatusForbidden, authenticationResponse{Error: "password reset required, send a new_password"})
+			return
+		}
+		if err := models.ValidatePassword(newPassword, user.Username); err != nil {
+			answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+			return
+		}
+		if user, err = s.db.UpdateUser(user, newPassword); err != nil {
+			answer(w, http.StatusInternalServerError, authenticationResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	// Create a short-lived access token and a refresh token for getting new ones
+	tokens, err := s.issueAPITokens(user, "")
+	if err != nil {
+		answer(w, http.StatusInternalServerError, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, tokens)
+}
+
+// refreshRequest exchanges a refresh token for new tokens, or revokes it when logging out
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// userRefreshAPIHandler exchanges a refresh token for a new access token and a new refresh token
+func (s *Server) userRefreshAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := refreshRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	tokens, status, err := s.refreshAPITokens(req.RefreshToken)
+	if err != nil {
+		answer(w, status, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, tokens)
+}
+
+// userLogoutAPIHandler revokes the access token in the Authorization header and the refresh token in the request
+// Either may be missing, so clients whose access token expired can log out with the refresh token
+func (s *Server) userLogoutAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode), the body may be empty
+	req := refreshRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		answer(w, http.StatusBadRequest, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	// An access token which is invalid or expired already doesn't have to be revoked
+	claims, _ := s.getTokenClaims(r)
+
+	if status, err := s.logoutAPI(claims, req.RefreshToken); err != nil {
+		answer(w, status, authenticationResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, authenticationResponse{})
+}
+
+// apiLoginLockedOut answers with 429 Too Many Requests when logins as username from the address of the request are
+// locked out, and tells the client when to try again. Returns true when the login has to stop
+func (s *Server) apiLoginLockedOut(w http.ResponseWriter, r *http.Request, username string) bool {
+	wait, err := s.loginRetryAfter(username, s.remoteIP(r))
+	if err != nil {
+		answer(w, http.StatusInternalServerError, authenticationResponse{Error: err.Error()})
+		return true
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		answer(w, http.StatusTooManyRequests, authenticationResponse{Error: lockedOutMessage(wait)})
+		return true
+	}
+	return false
+}
+
+// jwksHandler serves the public keys tokens are verified with as a JSON Web Key Set, so other services can verify
+// our tokens without sharing a secret. Keys which were rotated out are included until their files are removed
+func (s *Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	set := jwkSet{Keys: []jwk{}}
+	for _, key := range s.keys.Keys() {
+		k, err := toJWK(key)
+		if err != nil {
+			answer(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		set.Keys = append(set.Keys, k)
+	}
+
+	// The keys only change when the blog is restarted, verifiers may cache them for a while
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	answer(w, http.StatusOK, set)
+}
+
+// usersResponse can be used to send a response with a list of users
+type usersResponse struct {
+	Error string        `json:"error"`
+	Users []models.User `json:"users"`
+}
+
+// userResponse can be used to send a response with a single user
+type userResponse struct {
+	Error string      `json:"error"`
+	User  models.User `json:"user"`
+}
+
+// passwordResetRequest asks for a password reset link for the user with the username or the email address
+type passwordResetRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// passwordResetResponse is the answer to a password reset request, which doesn't tell if an account was found
+type passwordResetResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// passwordResetAPIHandler sends a password reset link to the email address of a user
+// It always answers 202 Accepted when the request is valid, whether an account was found or not
+func (s *Server) passwordResetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := passwordResetRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, passwordResetResponse{Error: err.Error()})
+		return
+	}
+
+	req.Username, req.Email = strings.TrimSpace(req.Username), strings.TrimSpace(req.Email)
+	if req.Username == "" && req.Email == "" {
+		answer(w, http.StatusBadRequest, passwordResetResponse{Error: "username or email is required"})
+		return
+	}
+
+	if err := s.requestPasswordReset(req.Username, req.Email); err != nil {
+		answer(w, http.StatusInternalServerError, passwordResetResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusAccepted, passwordResetResponse{
+		Message: "if an account with an email address was found, a password reset link has been sent to it",
+	})
+}
+
+// meGetAPIHandler gets the user authenticated with the token
+func (s *Server) meGetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	answer(w, http.StatusOK, userResponse{User: s.getTokenUser(r)})
+}
+
+// meUpdateAPIHandler changes the name or the password of the user authenticated with the token
+// Only the fields in the request are changed, changing the password requires the current password:
+// {"current_password": "old", "new_password": "new"}
+func (s *Server) meUpdateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := profileUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, userResponse{Error: err.Error()})
+		return
+	}
+
+	user, status, err := s.updateProfile(s.getTokenUser(r), req)
+	if err != nil {
+		answer(w, status, userResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, userResponse{User: user})
+}
+
+// meVerificationAPIHandler sends a new link to verify the email address of the user authenticated with the token
+func (s *Server) meVerificationAPIHandler(w http.ResponseWriter, r *http.Request) {
+	user, status, err := s.resendVerification(s.getTokenUser(r).Username)
+	if err != nil {
+		answer(w, status, userResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, status, userResponse{User: user})
+}
+
+// totpRequest contains the current password for changing the second factor, and a code of the authenticator app
+// to confirm a new secret
+type totpRequest struct {
+	Code            string `json:"code"`
+	CurrentPassword string `json:"current_password"`
+}
+
+// totpResponse can be used to send a response about two-factor authentication
+// The new secret is only sent while enabling it, the recovery codes only when they are created
+type totpResponse struct {
+	Error  string `json:"error"`
+	Secret string `json:"secret,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// QRCode is a PNG image of URL, base64 encoded
+	QRCode        []byte   `json:"qr_code,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// meTOTPCreateAPIHandler starts enabling two-factor authentication for the user authenticated with the token
+// The current password is required. The new secret has to be added to an authenticator app and confirmed with a
+// code at /api/me/totp/confirm
+func (s *Server) meTOTPCreateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := totpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, totpResponse{Error: err.Error()})
+		return
+	}
+
+	key, status, err := s.startTOTPEnrollment(s.getTokenUser(r), req.CurrentPassword)
+	if err != nil {
+		answer(w, status, totpResponse{Error: err.Error()})
+		return
+	}
+
+	qr, err := totpQRCode(key)
+	if err != nil {
+		answer(w, http.StatusInternalServerError, totpResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusCreated, totpResponse{Secret: key.Secret(), URL: key.URL(), QRCode: qr})
+}
+
+// meTOTPConfirmAPIHandler enables two-factor authentication with a code for the new secret and the current password
+// It answers with the recovery codes, they aren't shown again
+func (s *Server) meTOTPConfirmAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := totpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, totpResponse{Error: err.Error()})
+		return
+	}
+
+	codes, status, err := s.confirmTOTPEnrollment(s.getTokenUser(r), req.CurrentPassword, req.Code)
+	if err != nil {
+		answer(w, status, totpResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, totpResponse{RecoveryCodes: codes})
+}
+
+// meTOTPDeleteAPIHandler turns off two-factor authentication, the current password is required
+func (s *Server) meTOTPDeleteAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := totpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, totpResponse{Error: err.Error()})
+		return
+	}
+
+	status, err := s.disableTOTP(s.getTokenUser(r), req.CurrentPassword)
+	if err != nil {
+		answer(w, status, totpResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, totpResponse{})
+}
+
+// meRecoveryCodesAPIHandler replaces the recovery codes, the current password is required
+func (s *Server) meRecoveryCodesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := totpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, totpResponse{Error: err.Error()})
+		return
+	}
+
+	codes, status, err := s.regenerateRecoveryCodes(s.getTokenUser(r), req.CurrentPassword)
+	if err != nil {
+		answer(w, status, totpResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, totpResponse{RecoveryCodes: codes})
+}
+
+// usersGetAPIHandler gets all users, only for admins
+func (s *Server) usersGetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.GetUsers()
+	if err != nil {
+		answer(w, http.StatusInternalServerError, usersResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, usersResponse{Users: users})
+}
+
+// userGetAPIHandler gets a single user, only for admins
+func (s *Server) userGetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	user, err := s.db.GetUserByUsername(args["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			answer(w, http.StatusNotFound, userResponse{Error: err.Error()})
+			return
+		}
+
+		answer(w, http.StatusInternalServerError, userResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, userResponse{User: user})
+}
+
+// userUpdateAPIHandler changes the name, role and account state of a user, only for admins
+// Only the fields in the request are changed, for example {"disabled": true} disables the account and
+// {"password_reset": true} forces the user to choose a new password at the next login
+func (s *Server) userUpdateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Decode the request (https://golang.org/pkg/encoding/json/#Decoder.Decode)
+	req := userUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		answer(w, http.StatusBadRequest, userResponse{Error: err.Error()})
+		return
+	}
+
+	user, status, err := s.updateUser(s.getTokenUser(r), args["username"], req)
+	if err != nil {
+		answer(w, status, userResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, userResponse{User: user})
+}
+
+// userDeleteAPIHandler deletes a user, only for admins
+// Users who still have posts can't be deleted, disable them instead
+func (s *Server) userDeleteAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	user, status, err := s.deleteUser(s.getTokenUser(r), args["username"])
+	if err != nil {
+		answer(w, status, userResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, userResponse{User: user})
+}
+
+// userVerificationAPIHandler sends a new email verification link to a user, only for admins
+// Admins can also verify the address directly by updating the user with email_verified
+func (s *Server) userVerificationAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	user, status, err := s.resendVerification(args["username"])
+	if err != nil {
+		answer(w, status, userResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, status, userResponse{User: user})
+}
+
+// throttlesResponse can be used to send a response with a list of login throttles
+type throttlesResponse struct {
+	Error     string                 `json:"error"`
+	Throttles []models.LoginThrottle `json:"throttles"`
+}
+
+// locksGetAPIHandler gets the usernames and IP addresses with recent failed logins, and whether they are locked out,
+// only for admins
+func (s *Server) locksGetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	throttles, err := s.db.GetLoginThrottles(time.Now().Add(-ThrottleWindow))
+	if err != nil {
+		answer(w, http.StatusInternalServerError, throttlesResponse{Error: err.Error()})
+		return
+	}
+
+	answer(w, http.StatusOK, throttlesResponse{Throttles: throttles})
+}
+
+// lockDeleteAPIHandler forgets the failed logins of a username or an IP address and lifts its lockout, only for admins
+func (s *Server) lockDeleteAPIHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	if status, err := s.clearLoginThrottle(args["kind"], args["value"]); err != nil {
+		answer(w, status, throttlesResponse{Error: err.Error()})
 		return
 	}
 
-	answer(w, http.StatusOK, authenticationResponse{Token: token})
+	answer(w, http.StatusOK, throttlesResponse{})
 }
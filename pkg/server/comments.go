@@ -0,0 +1,127 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// addComment adds a comment to a post, on behalf of the user or anonymously if the user is empty
+// Comments can only be added to posts the user can read, commentStatus decides whether they need moderation
+// Returns the stored comment, or the HTTP status and the error which prevented storing it
+func (s *Server) addComment(sub models.CommentSubmission, user models.User) (models.Comment, int, error) {
+	comment := sub.Comment
+	post, err := s.db.GetPostBySlug(comment.Slug, user.Viewer())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return comment, http.StatusNotFound, err
+		}
+		return comment, http.StatusBadRequest, err
+	}
+
+	// Every role may comment, but check it in case a role without that permission is added
+	if user.ID != 0 && !user.Can(models.PermComment) {
+		return comment, http.StatusForbidden, fmt.Errorf("your role %q doesn't allow commenting", user.Role)
+	}
+
+	// Users are known by their account, the name and email are only stored for anonymous commenters
+	comment.UserID = user.ID
+	comment.Name = strings.TrimSpace(comment.Name)
+	comment.Email = strings.TrimSpace(comment.Email)
+	if user.ID != 0 {
+		comment.Name, comment.Email = "", ""
+	}
+
+	// Perform validation
+	if err := comment.Validate(); err != nil {
+		return comment, http.StatusBadRequest, err
+	}
+
+	// Check the comment to reply to before scoring, the spam scorer remembers every comment it scores and a reply which
+	// can't be stored shouldn't count as a submission
+	if err := s.checkCommentParent(comment); err != nil {
+		if err == database.ErrCommentParent {
+			return comment, http.StatusBadRequest, err
+		}
+		return comment, http.StatusInternalServerError, err
+	}
+
+	sub.Comment = comment
+	comment.Status, comment.SpamScore, err = s.commentStatus(sub, post, user)
+	if err != nil {
+		return comment, http.StatusInternalServerError, err
+	}
+
+	comment, err = s.db.CreateComment(comment)
+	if err != nil {
+		if err == database.ErrCommentParent {
+			return comment, http.StatusBadRequest, err
+		}
+		return comment, http.StatusInternalServerError, err
+	}
+
+	return comment, http.StatusCreated, nil
+}
+
+// checkCommentParent checks that a reply replies to an approved comment on the same post, like CreateComment does
+// Returns database.ErrCommentParent if it doesn't
+func (s *Server) checkCommentParent(comment models.Comment) error {
+	if comment.ParentID == 0 {
+		return nil
+	}
+
+	comments, err := s.db.GetComments(comment.Slug, models.CommentApproved)
+	if err != nil {
+		return err
+	}
+	for _, c := range comments {
+		if c.ID == comment.ParentID {
+			return nil
+		}
+	}
+
+	return database.ErrCommentParent
+}
+
+// commentStatus decides the moderation state of a new comment and returns it with its spam score
+// Spam is recognized first. Comments of users who can moderate the post are approved, like comments of users who had
+// a comment approved before if the post auto-approves them. Anonymous commenters are never approved automatically,
+// because nothing proves the email address they enter is theirs. Everything else waits for moderation
+func (s *Server) commentStatus(sub models.CommentSubmission, post models.Post, user models.User) (string, float64, error) {
+	score := s.SpamScorer.Score(sub)
+	if score.Spam() {
+		log.Printf("comment on %s marked as spam: %s", post.Slug, strings.Join(score.Reasons, ", "))
+		return models.CommentSpam, score.Score, nil
+	}
+
+	if user.CanEditPost(post) {
+		return models.CommentApproved, score.Score, nil
+	}
+
+	if post.AutoApproveComments && user.ID != 0 {
+		approved, err := s.db.IsApprovedCommenter(user.ID)
+		if err != nil {
+			return "", score.Score, err
+		}
+		if approved {
+			return models.CommentApproved, score.Score, nil
+		}
+	}
+
+	return models.CommentPending, score.Score, nil
+}
+
+// getCommentThreads gets the approved comments on a post, threaded with their replies
+func (s *Server) getCommentThreads(slug string) ([]models.Comment, error) {
+	comments, err := s.db.GetComments(slug, models.CommentApproved)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.ThreadComments(comments), nil
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// TestAddCommentInvalidParent replies to comments which can't be replied to, those replies are refused before the spam
+// scorer sees them. Otherwise they would count as repeats and against the limit of comments per sender
+func TestAddCommentInvalidParent(t *testing.T) {
+	s := newTestServer(t)
+	author := createTestUser(t, s, "alice", "author")
+	reader := createTestUser(t, s, "bob", "reader")
+
+	for _, slug := range []string{"first", "second"} {
+		post := models.Post{Slug: slug, UserID: author.ID, Title: slug, Markdown: slug, Status: models.StatusPublished}
+		if _, err := s.db.CreatePost(post); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	comment := func(slug string, parent int64) models.CommentSubmission {
+		return models.CommentSubmission{Comment: models.Comment{Slug: slug, ParentID: parent, Body: "Nice post"}, IP: "203.0.113.7"}
+	}
+
+	pending, status, err := s.addComment(comment("first", 0), reader)
+	if status != http.StatusCreated {
+		t.Fatalf("comment: %d %v", status, err)
+	}
+	other, status, err := s.addComment(models.CommentSubmission{Comment: models.Comment{Slug: "second", Body: "Other post"}}, author)
+	if status != http.StatusCreated {
+		t.Fatalf("comment on the other post: %d %v", status, err)
+	}
+
+	tests := []struct {
+		name   string
+		parent int64
+	}{
+		{"missing comment", 1000},
+		{"pending comment", pending.ID},
+		{"comment on another post", other.ID},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ {
+			if _, status, _ := s.addComment(comment("first", tt.parent), reader); status != http.StatusBadRequest {
+				t.Fatalf("reply to %s: got status %d, want %d", tt.name, status, http.StatusBadRequest)
+			}
+		}
+	}
+
+	// Only the first comment was scored before
+	c, status, err := s.addComment(comment("second", 0), reader)
+	if status != http.StatusCreated {
+		t.Fatalf("comment after the refused replies: %d %v", status, err)
+	}
+	if c.Status == models.CommentSpam || c.SpamScore > 0.4 {
+		t.Errorf("comment after the refused replies got status %s and score %v", c.Status, c.SpamScore)
+	}
+}
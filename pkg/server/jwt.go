@@ -1,15 +1,14 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
+	"time"
 
 	jwtlib "github.com/dgrijalva/jwt-go"
 )
 
-// TokenEncodeString is the byte string used for encoding/decoding JWT tokens.
-// It's recommended to change this value for every use of the package
-var TokenEncodeString = []byte("gfe895tu359hjteijte4hjaurhtuh59yjh5e")
-
 // Issuer is the value used as a JWT Claim issuer.
 var Issuer = "MyOrganisation"
 
@@ -19,11 +18,28 @@ type Claims struct {
 	jwtlib.StandardClaims
 }
 
-// CreateToken will create new JWT token with the provided data
-func CreateToken(data map[string]interface{}, expires int64) (string, error) {
+// newTokenID creates a random ID for a JWT token, the jti claim, which is used to revoke the token
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateToken will create new JWT token with the provided data, signed with the current key of the server
+// Every token gets its own ID, so it can be revoked before it expires
+func (s *Server) CreateToken(data map[string]interface{}, expires int64) (string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
 	claims := &Claims{
 		Data: make(map[string]interface{}),
 		StandardClaims: jwtlib.StandardClaims{
+			Id:        id,
+			IssuedAt:  time.Now().Unix(),
 			ExpiresAt: expires,
 			Issuer:    Issuer,
 		},
@@ -31,20 +47,40 @@ func CreateToken(data map[string]interface{}, expires int64) (string, error) {
 	for k, v := range data {
 		claims.Data[k] = v
 	}
-	token := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, claims)
+
+	// The kid header tells which key signed the token, so it can still be verified after the keys are rotated
+	key := s.keys.Current()
+	token := jwtlib.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
 
 	token.Claims = claims
 
-	return token.SignedString(TokenEncodeString)
+	return token.SignedString(key.Private)
 }
 
 // ParseToken parses a JWT token and returns the custom data of the token
-func ParseToken(t string) (map[string]interface{}, error) {
+func (s *Server) ParseToken(t string) (map[string]interface{}, error) {
+	claims, err := s.ParseTokenClaims(t)
+	if err != nil {
+		return nil, err
+	}
+	return claims.Data, nil
+}
+
+// ParseTokenClaims parses a JWT token and returns all its claims, including the ID and the expiry of the token
+// The token has to be signed by one of the keys of the server
+func (s *Server) ParseTokenClaims(t string) (*Claims, error) {
 	token, err := jwtlib.ParseWithClaims(t, &Claims{}, func(token *jwtlib.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwtlib.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("invalid signing method %v", token.Method)
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.keys.Key(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
 		}
-		return TokenEncodeString, nil
+		// The algorithm has to be the one of the key, so a token can't choose how it's verified
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("invalid signing method %v", token.Method.Alg())
+		}
+		return key.Public, nil
 	})
 	if err != nil {
 		return nil, err
@@ -54,6 +90,5 @@ func ParseToken(t string) (map[string]interface{}, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
-	claims := token.Claims.(*Claims)
-	return claims.Data, nil
+	return token.Claims.(*Claims), nil
 }
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	jwtlib "github.com/dgrijalva/jwt-go"
+)
+
+// The algorithms tokens can be signed with, they follow from the type of the key
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// signingMethodEdDSA signs tokens with Ed25519 keys (RFC 8037), jwt-go only comes with HMAC, RSA and ECDSA
+type signingMethodEdDSA struct{}
+
+// SigningMethodEdDSA is the signing method of tokens signed with Ed25519 keys
+var SigningMethodEdDSA jwtlib.SigningMethod = signingMethodEdDSA{}
+
+func init() {
+	// Register the method, so the parser finds it by the alg header of the tokens
+	jwtlib.RegisterSigningMethod(AlgEdDSA, func() jwtlib.SigningMethod { return SigningMethodEdDSA })
+}
+
+// Alg returns the alg header of tokens signed with the method
+func (signingMethodEdDSA) Alg() string {
+	return AlgEdDSA
+}
+
+// Sign signs the header and the claims with an ed25519.PrivateKey
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwtlib.ErrInvalidKeyType
+	}
+	return jwtlib.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+// Verify checks the signature of the header and the claims with an ed25519.PublicKey
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwtlib.ErrInvalidKeyType
+	}
+	sig, err := jwtlib.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return errors.New("signature is invalid")
+	}
+	return nil
+}
+
+// SigningKey is a key of a KeyRing
+type SigningKey struct {
+	// ID is sent as the kid header of the tokens, so the key which verifies them can be found
+	ID string
+	// Method signs and verifies the tokens, it follows from the type of the key
+	Method jwtlib.SigningMethod
+	// Private signs the tokens, it's nil for keys which only verify tokens signed before a rotation
+	Private crypto.Signer
+	// Public verifies the tokens
+	Public crypto.PublicKey
+}
+
+// KeyRing contains the keys tokens are signed and verified with
+// One key signs the new tokens, the others keep verifying the tokens they signed before they were rotated out
+type KeyRing struct {
+	keys    map[string]SigningKey
+	current string
+}
+
+// LoadKeyRing loads the keys from the PEM files in a directory, the name of a file without .pem is the ID of its key
+// The files contain a private key in PKCS #8, PKCS #1 or SEC 1 format, or only a public key in PKIX format for keys
+// which were rotated out. current is the ID of the key which signs new tokens, if it's empty the last key with a
+// private key is used, by the names of the files. Naming the files after the date they were created rotates the keys
+// by adding a new file
+func LoadKeyRing(dir, current string) (*KeyRing, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	kr := &KeyRing{keys: make(map[string]SigningKey)}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parseSigningKey(strings.TrimSuffix(filepath.Base(file), ".pem"), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		kr.keys[key.ID] = key
+		if key.Private != nil && (current == "" || current == key.ID) {
+			kr.current = key.ID
+		}
+	}
+
+	if len(kr.keys) == 0 {
+		return nil, fmt.Errorf("there are no keys in %s", dir)
+	}
+	if kr.current == "" {
+		if current != "" {
+			return nil, fmt.Errorf("there is no private key %q in %s", current, dir)
+		}
+		return nil, fmt.Errorf("there is no private key in %s", dir)
+	}
+
+	return kr, nil
+}
+
+// parseSigningKey parses the key in a PEM file
+func parseSigningKey(id string, data []byte) (SigningKey, error) {
+	key := SigningKey{ID: id}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return key, errors.New("no PEM data found")
+	}
+
+	var (
+		parsed interface{}
+		err    error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return key, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return key, err
+	}
+
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.Private, key.Public = signer, signer.Public()
+	} else {
+		key.Public = parsed
+	}
+
+	if key.Method, err = signingMethod(key.Public); err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
+// signingMethod returns the signing method for the type of a key
+// Only the key sizes and curves of RS256, ES256 and EdDSA are accepted
+func signingMethod(pub crypto.PublicKey) (jwtlib.SigningMethod, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys need at least 2048 bits, not %d", k.N.BitLen())
+		}
+		return jwtlib.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ECDSA keys have to use the P-256 curve, not %s", k.Curve.Params().Name)
+		}
+		return jwtlib.SigningMethodES256, nil
+	case ed25519.PublicKey:
+		return SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", pub)
+}
+
+// Current returns the key which signs new tokens
+func (kr *KeyRing) Current() SigningKey {
+	return kr.keys[kr.current]
+}
+
+// Key returns the key with the ID, to verify a token
+func (kr *KeyRing) Key(id string) (SigningKey, bool) {
+	key, ok := kr.keys[id]
+	return key, ok
+}
+
+// Keys returns all keys, ordered by ID
+func (kr *KeyRing) Keys() []SigningKey {
+	keys := make([]SigningKey, 0, len(kr.keys))
+	for _, key := range kr.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// NewKeyRing creates a key ring with a single new private key for the algorithm, which is only kept in memory
+// Tokens signed with it can't be verified anymore after a restart, so it suits servers which don't keep their data
+// either, like the ones on database.NewMemory()
+func NewKeyRing(alg string) (*KeyRing, error) {
+	key, err := generatePrivateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	signing := SigningKey{ID: time.Now().UTC().Format("20060102-150405"), Private: key, Public: key.Public()}
+	if signing.Method, err = signingMethod(signing.Public); err != nil {
+		return nil, err
+	}
+
+	return &KeyRing{keys: map[string]SigningKey{signing.ID: signing}, current: signing.ID}, nil
+}
+
+// generatePrivateKey creates a new private key for the algorithm
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case AlgRS256:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q, use %s, %s or %s", alg, AlgRS256, AlgES256, AlgEdDSA)
+}
+
+// GenerateKey creates a new private key for the algorithm and writes it to a PEM file in PKCS #8 format in the
+// directory. The file is named after the current time, so LoadKeyRing picks the newest key to sign new tokens
+// Returns the ID of the new key
+func GenerateKey(dir, alg string) (string, error) {
+	key, err := generatePrivateKey(alg)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	// The private key is only readable by the owner, and an existing key is never overwritten
+	id := time.Now().UTC().Format("20060102-150405")
+	f, err := os.OpenFile(filepath.Join(dir, id+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return "", err
+	}
+	return id, f.Close()
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517), for other services which verify our tokens
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// N and E are the modulus and the exponent of RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv is the curve of ECDSA and Ed25519 keys, X and Y are the coordinates of the public key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwkSet is a set of JSON Web Keys, as served at /.well-known/jwks.json
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// toJWK returns the public key of a signing key in JSON Web Key format
+func toJWK(key SigningKey) (jwk, error) {
+	k := jwk{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = jwtlib.EncodeSegment(pub.N.Bytes())
+		k.E = jwtlib.EncodeSegment(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// The uncompressed point is 0x04 followed by the coordinates, which have a fixed size
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return k, err
+		}
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		k.Kty, k.Crv = "EC", "P-256"
+		k.X = jwtlib.EncodeSegment(point[1 : 1+size])
+		k.Y = jwtlib.EncodeSegment(point[1+size:])
+	case ed25519.PublicKey:
+		k.Kty, k.Crv = "OKP", "Ed25519"
+		k.X = jwtlib.EncodeSegment(pub)
+	default:
+		return k, fmt.Errorf("unsupported key type %T", pub)
+	}
+
+	return k, nil
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/png"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// TOTPIssuer is shown as the name of the account in authenticator apps, next to the username
+var TOTPIssuer = "Go Blog!"
+
+// MFAChallengeTTL is how long users have to enter their second factor after their password
+var MFAChallengeTTL = 5 * time.Minute
+
+// RecoveryCodeCount is the number of recovery codes users get when they enable two-factor authentication
+const RecoveryCodeCount = 10
+
+// The codes of the authenticator apps are the RFC 6238 defaults, which are the only ones all apps support
+const (
+	totpPeriod = 30
+	totpDigits = otp.DigitsSix
+	// totpSkew accepts the codes of the previous and the next time step, for clocks which are a bit off
+	totpSkew = 1
+)
+
+// recoveryCodeAlphabet leaves out letters and digits which are easily confused, like 0 and o
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// errInvalidCode is returned when a code of the authenticator app or a recovery code is wrong
+var errInvalidCode = errors.New("the code is invalid")
+
+// totpKey returns the key of the TOTP secret of a user, which contains everything authenticator apps need
+func totpKey(user models.User) (*otp.Key, error) {
+	label := url.PathEscape(TOTPIssuer + ":" + user.Username)
+	v := url.Values{}
+	v.Set("secret", user.TOTPSecret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("period", fmt.Sprint(totpPeriod))
+	v.Set("digits", totpDigits.String())
+	v.Set("algorithm", otp.AlgorithmSHA1.String())
+	return otp.NewKeyFromURL("otpauth://totp/" + label + "?" + v.Encode())
+}
+
+// totpQRCode renders the key of a user as a QR code in PNG format, to scan with an authenticator app
+// The image is made here, so the secret is never sent to another service
+func totpQRCode(key *otp.Key) ([]byte, error) {
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// startTOTPEnrollment creates a new TOTP secret for a user, which has to be confirmed with a code before it's used
+// Asking again replaces a secret which wasn't confirmed. The current password is required, or a stolen token or
+// session would be enough to enable it with another app and lock the owner out
+// Returns the key to show to the user, or the HTTP status and the error which prevented the enrollment
+func (s *Server) startTOTPEnrollment(user models.User, password string) (*otp.Key, int, error) {
+	if err := checkPassword(user, password); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if user.TOTPEnabled {
+		return nil, http.StatusConflict, fmt.Errorf("two-factor authentication is enabled already")
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      TOTPIssuer,
+		AccountName: user.Username,
+		Period:      totpPeriod,
+		Digits:      totpDigits,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := s.db.SetUserTOTP(user.ID, key.Secret(), false); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return key, http.StatusOK, nil
+}
+
+// pendingTOTPKey returns the key of a TOTP secret which still has to be confirmed
+// Returns the HTTP status and an error if the user didn't start an enrollment
+func pendingTOTPKey(user models.User) (*otp.Key, int, error) {
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		return nil, http.StatusNotFound, fmt.Errorf("start enabling two-factor authentication first")
+	}
+
+	key, err := totpKey(user)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return key, http.StatusOK, nil
+}
+
+// confirmTOTPEnrollment enables two-factor authentication after the user entered a code for the new secret
+// The current password is required, like for starting the enrollment
+// Returns the new recovery codes, which are shown only once, or the HTTP status and the error which prevented it
+func (s *Server) confirmTOTPEnrollment(user models.User, password, code string) ([]string, int, error) {
+	if err := checkPassword(user, password); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if _, status, err := pendingTOTPKey(user); err != nil {
+		return nil, status, err
+	}
+
+	if err := s.checkTOTPCode(user, code); err != nil {
+		if err == errInvalidCode || err == database.ErrTOTPCodeUsed {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := s.db.SetUserTOTP(user.ID, user.TOTPSecret, true); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	codes, err := s.newRecoveryCodes(user)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return codes, http.StatusOK, nil
+}
+
+// checkPassword checks the current password of a user, before changes which would let someone take over the account
+func checkPassword(user models.User, password string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return fmt.Errorf("the current password is wrong")
+	}
+	return nil
+}
+
+// disableTOTP turns off two-factor authentication of a user, which requires the current password
+// Returns the HTTP status and the error which prevented it
+func (s *Server) disableTOTP(user models.User, password string) (int, error) {
+	if err := checkPassword(user, password); err != nil {
+		return http.StatusForbidden, err
+	}
+
+	if err := s.removeTOTP(user); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// removeTOTP removes the TOTP secret and the recovery codes of a user
+func (s *Server) removeTOTP(user models.User) error {
+	if err := s.db.SetUserTOTP(user.ID, "", false); err != nil {
+		return err
+	}
+	return s.db.ReplaceRecoveryCodes(user.ID, nil)
+}
+
+// regenerateRecoveryCodes replaces the recovery codes of a user, which requires the current password
+// Returns the new recovery codes, or the HTTP status and the error which prevented it
+func (s *Server) regenerateRecoveryCodes(user models.User, password string) ([]string, int, error) {
+	if err := checkPassword(user, password); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if !user.TOTPEnabled {
+		return nil, http.StatusBadRequest, fmt.Errorf("two-factor authentication isn't enabled")
+	}
+
+	codes, err := s.newRecoveryCodes(user)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return codes, http.StatusOK, nil
+}
+
+// newRecoveryCodes creates new recovery codes for a user and stores their hashes, replacing the old codes
+func (s *Server) newRecoveryCodes(user models.User) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i], hashes[i] = code, hashToken(normalizeCode(code))
+	}
+
+	if err := s.db.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// newRecoveryCode creates a random recovery code, formatted like abcde-fghjk so it's easy to copy
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	max := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = recoveryCodeAlphabet[n.Int64()]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+// normalizeCode removes the spaces and dashes users may type in codes, and lower cases recovery codes
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+// checkSecondFactor checks the code a user entered after the password: a code of the authenticator app, or one of
+// the recovery codes which is used up by it
+// Returns errInvalidCode or database.ErrTOTPCodeUsed if the code isn't accepted
+func (s *Server) checkSecondFactor(user models.User, code string) error {
+	code = normalizeCode(code)
+	if len(code) == totpDigits.Length() {
+		return s.checkTOTPCode(user, code)
+	}
+
+	if err := s.db.UseRecoveryCode(user.ID, hashToken(code)); err != nil {
+		if err == sql.ErrNoRows {
+			return errInvalidCode
+		}
+		return err
+	}
+	return nil
+}
+
+// checkTOTPCode checks a code of the authenticator app for the TOTP secret of the user
+// Every code can only be used once, a code of an earlier time step than the last one isn't accepted either
+func (s *Server) checkTOTPCode(user models.User, code string) error {
+	code = normalizeCode(code)
+	now := time.Now()
+
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: totpDigits, Algorithm: otp.AlgorithmSHA1}
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(user.TOTPSecret, t, opts)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s.db.UseTOTPCounter(user.ID, t.Unix()/totpPeriod)
+		}
+	}
+
+	return errInvalidCode
+}
+
+// createMFAChallenge creates the token which proves the password of a user was correct, it's exchanged for a login
+// together with the second factor. It has no activeUser claim, so it can't be used to authenticate
+func (s *Server) createMFAChallenge(user models.User) (string, error) {
+	return s.CreateToken(map[string]interface{}{"mfaUser": user.Username}, time.Now().Add(MFAChallengeTTL).Unix())
+}
+
+// parseMFAChallenge returns the username of an MFA challenge token
+func (s *Server) parseMFAChallenge(challenge string) (string, error) {
+	claims, err := s.ParseToken(challenge)
+	if err != nil {
+		return "", fmt.Errorf("the challenge is invalid or has expired, login again")
+	}
+	username, ok := claims["mfaUser"].(string)
+	if !ok || username == "" {
+		return "", fmt.Errorf("the challenge is invalid or has expired, login again")
+	}
+	return username, nil
+}
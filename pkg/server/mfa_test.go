@@ -0,0 +1,60 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+)
+
+// TestCheckTOTPCode enters codes of the authenticator app one after another, a code can't be used twice and a code
+// of an earlier time step isn't accepted after a later one
+func TestCheckTOTPCode(t *testing.T) {
+	// The steps are relative to the current time step, wait for the next one if it's about to change
+	if left := totpPeriod - time.Now().Unix()%totpPeriod; left < 2 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+	now := time.Now()
+
+	steps := []struct {
+		name string
+		step int
+		want error
+	}{
+		{"current code", 0, nil},
+		{"same code again", 0, database.ErrTOTPCodeUsed},
+		{"previous code", -1, database.ErrTOTPCodeUsed},
+		{"next code", 1, nil},
+		{"next code again", 1, database.ErrTOTPCodeUsed},
+		{"current code after the next", 0, database.ErrTOTPCodeUsed},
+		{"code outside the skew", totpSkew + 2, errInvalidCode},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.db = store
+			user := createTestUser(t, s, "alice", "author")
+
+			user.TOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+			if err := s.db.SetUserTOTP(user.ID, user.TOTPSecret, true); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := totp.ValidateOpts{Period: totpPeriod, Digits: totpDigits, Algorithm: otp.AlgorithmSHA1}
+			for _, st := range steps {
+				code, err := totp.GenerateCodeCustom(user.TOTPSecret, now.Add(time.Duration(st.step*totpPeriod)*time.Second), opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := s.checkTOTPCode(user, code); err != st.want {
+					t.Errorf("%s: got %v, want %v", st.name, err, st.want)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
 )
 
 // ReqAuth is a middleware function to ensure that a route can only be accessed by an authenticated user
@@ -25,19 +27,29 @@ func (s *Server) ReqAuth(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Check if this is a valid user
-		if _, err := s.db.GetUserByUsername(au.(string)); err != nil {
+		user, err := s.db.GetUserByUsername(au.(string))
+		if err != nil {
 			// We didn't get a valid user from the db, so we'll deny access
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
+		// Disabled users and users who have to choose a new password are logged out right away
+		if !user.Active() {
+			clearActiveUser(session)
+			session.AddFlash(inactiveReason(user))
+			session.Save(r, w)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
 		// Everything went well, let's invoke the next HandlerFunc
 		next(w, r)
 	}
 }
 
-// getUserFromToken will extract the active user from the request headers
-func getUserFromToken(r *http.Request) (string, error) {
+// getTokenClaims will extract the claims of the access token from the request headers
+func (s *Server) getTokenClaims(r *http.Request) (*Claims, error) {
 	// Get the authorization header
 	// The header is expected to be formatted as: Authorization: BEARER <token>
 	authData := r.Header.Get("Authorization")
@@ -46,41 +58,167 @@ func getUserFromToken(r *http.Request) (string, error) {
 	parts := strings.Split(authData, " ")
 	// Check whether it's a bearer token
 	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-		return "", fmt.Errorf("invalid header")
+		return nil, fmt.Errorf("invalid header")
 	}
 
 	// Parse the token to get the claims
-	claims, err := ParseToken(parts[1])
+	claims, err := s.ParseTokenClaims(parts[1])
 	if err != nil {
-		return "", fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
 
 	// Get the active user from the claims
-	au, ok := claims["activeUser"].(string)
-	if !ok {
+	if au, ok := claims.Data["activeUser"].(string); !ok || au == "" {
 		// We didn't get an active user, so nobody is logged in
-		return "", fmt.Errorf("invalid value")
+		return nil, fmt.Errorf("invalid value")
 	}
 
-	return au, nil
+	return claims, nil
+}
+
+// getUserFromToken will extract the active user from the request headers
+func (s *Server) getUserFromToken(r *http.Request) (string, error) {
+	claims, err := s.getTokenClaims(r)
+	if err != nil {
+		return "", err
+	}
+	return claims.Data["activeUser"].(string), nil
+}
+
+// checkTokenRevoked returns an error if the access token was revoked, by logging out
+// Tokens without an ID were issued before tokens could be revoked, they aren't accepted anymore
+func (s *Server) checkTokenRevoked(claims *Claims) error {
+	if claims.Id == "" {
+		return fmt.Errorf("the token can't be revoked, log in again")
+	}
+
+	revoked, err := s.db.IsTokenRevoked(claims.Id)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return fmt.Errorf("the token has been revoked")
+	}
+	return nil
+}
+
+// getTokenUser returns the user authenticated with the token, or an empty user if the request has no valid token or the
+// user isn't active
+// It's used by routes which are public, but show more to authenticated users
+func (s *Server) getTokenUser(r *http.Request) models.User {
+	claims, err := s.getTokenClaims(r)
+	if err != nil || s.checkTokenRevoked(claims) != nil {
+		return models.User{}
+	}
+
+	user, err := s.db.GetUserByUsername(claims.Data["activeUser"].(string))
+	if err != nil || !user.Active() {
+		return models.User{}
+	}
+
+	return user
+}
+
+// inactiveReason explains why a user who isn't active can't use the blog
+func inactiveReason(user models.User) string {
+	if user.Disabled {
+		return "your account is disabled"
+	}
+	return "you have to choose a new password, log in again"
+}
+
+// requestUser returns the user making the request, authenticated with a token for API routes and with the session
+// for web routes. Returns an empty user if nobody is authenticated
+func (s *Server) requestUser(r *http.Request) models.User {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return s.getTokenUser(r)
+	}
+	return s.activeUser(r)
+}
+
+// RequireRole is a middleware function to ensure that a route can only be accessed by users with one of the roles
+// Use it after ReqAuth or ReqToken: s.ReqToken(s.RequireRole(models.RoleAdmin)(handler))
+func (s *Server) RequireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return s.requireUser(func(user models.User) bool {
+		for _, role := range roles {
+			if user.Role == role {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequirePermission is a middleware function to ensure that a route can only be accessed by users whose role grants
+// the permission. Use it after ReqAuth or ReqToken: s.ReqAuth(s.RequirePermission(models.PermWritePosts)(handler))
+func (s *Server) RequirePermission(p models.Permission) func(http.HandlerFunc) http.HandlerFunc {
+	return s.requireUser(func(user models.User) bool {
+		return user.Can(p)
+	})
+}
+
+// requireUser returns a middleware function which only invokes the next HandlerFunc if the user is allowed
+// The role is read from the database rather than from the session or token, so a changed role applies right away
+func (s *Server) requireUser(allowed func(user models.User) bool) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			api := strings.HasPrefix(r.URL.Path, "/api/")
+
+			user := s.requestUser(r)
+			if user.ID == 0 {
+				if api {
+					answer(w, http.StatusUnauthorized, nil)
+					return
+				}
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+
+			if !allowed(user) {
+				msg := fmt.Sprintf("your role %q doesn't allow this", user.Role)
+				if api {
+					answer(w, http.StatusForbidden, msg)
+					return
+				}
+				http.Error(w, msg, http.StatusForbidden)
+				return
+			}
+
+			// Everything went well, let's invoke the next HandlerFunc
+			next(w, r)
+		}
+	}
 }
 
 // ReqToken is a middleware function to ensure that a route can only be accessed by an authenticated user
 func (s *Server) ReqToken(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		au, err := getUserFromToken(r)
+		claims, err := s.getTokenClaims(r)
 		if err != nil {
 			answer(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
+		// Tokens which were revoked are rejected, even though they haven't expired yet
+		if err := s.checkTokenRevoked(claims); err != nil {
+			answer(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
 		// Check if this is a valid user
-		if _, err := s.db.GetUserByUsername(au); err != nil {
+		user, err := s.db.GetUserByUsername(claims.Data["activeUser"].(string))
+		if err != nil {
 			// We didn't get a valid user from the db, so we'll deny access
 			answer(w, http.StatusUnauthorized, nil)
 			return
 		}
 
+		// Tokens of disabled users and of users who have to choose a new password are rejected right away
+		if !user.Active() {
+			answer(w, http.StatusUnauthorized, inactiveReason(user))
+			return
+		}
+
 		// Everything went well, let's invoke the next HandlerFunc
 		next(w, r)
 	}
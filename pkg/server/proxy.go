@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and networks in CIDR notation, like
+// "10.0.0.1, 192.168.0.0/16", for Server.TrustedProxies
+func ParseTrustedProxies(list string) (proxies []*net.IPNet, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// A single address is a network with only that address in it
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// trustedProxy checks if an address belongs to one of the trusted proxies
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, network := range s.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address a request was sent from, without the port
+// Behind a reverse proxy every request comes from the proxy, which adds the address it got the request from to the
+// X-Forwarded-For header. Clients can send the header themselves, so it's only used when the request comes from one of
+// the TrustedProxies. Its addresses are followed from right to left, past the trusted proxies, and the first address
+// which isn't a trusted proxy is the client
+func (s *Server) remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !s.trustedProxy(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			// Whatever is left of an invalid address can't be trusted, stop at the last proxy
+			break
+		}
+		host = ip.String()
+		if !s.trustedProxy(ip) {
+			break
+		}
+	}
+
+	return host
+}
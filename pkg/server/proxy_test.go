@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("127.0.0.1, 10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{TrustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"header of untrusted client", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "127.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted ipv6 proxy", "[::1]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entry before the client", "127.0.0.1:1234", []string{"192.0.2.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "127.0.0.1:1234", []string{"198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"multiple headers", "127.0.0.1:1234", []string{"198.51.100.1", "10.1.2.3"}, "198.51.100.1"},
+		{"only proxies", "127.0.0.1:1234", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"no header", "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"invalid entry", "127.0.0.1:1234", []string{"198.51.100.1, bogus, 10.1.2.3"}, "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := s.remoteIP(r); got != tt.want {
+				t.Errorf("remoteIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, list := range []string{"bogus", "10.0.0.0/33", "127.0.0.1, 10.0.0.1/"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) returned no error", list)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// publishInterval is how often the publisher checks for scheduled posts which are due
+const publishInterval = time.Minute
+
+// startPublisher starts the goroutine which publishes scheduled posts when they are due
+// It does nothing if the publisher is already running
+func (s *Server) startPublisher() {
+	s.publisherMu.Lock()
+	defer s.publisherMu.Unlock()
+
+	if s.stopPublisher != nil {
+		return
+	}
+
+	// The publisher closes done when it has stopped, so Close can wait for it
+	stop, done := make(chan struct{}), make(chan struct{})
+	s.stopPublisher, s.publisherDone = stop, done
+
+	go func() {
+		defer close(done)
+
+		// Use a ticker to check periodically (https://gobyexample.com/tickers)
+		ticker := time.NewTicker(publishInterval)
+		defer ticker.Stop()
+
+		for {
+			s.publishDuePosts()
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// haltPublisher stops the publisher and waits until it's done
+// It does nothing if the publisher isn't running
+func (s *Server) haltPublisher() {
+	s.publisherMu.Lock()
+	defer s.publisherMu.Unlock()
+
+	if s.stopPublisher == nil {
+		return
+	}
+
+	close(s.stopPublisher)
+	<-s.publisherDone
+	s.stopPublisher, s.publisherDone = nil, nil
+}
+
+// publishDuePosts publishes the scheduled posts which are due
+func (s *Server) publishDuePosts() {
+	published, err := s.db.PublishDuePosts(time.Now())
+	if err != nil {
+		log.Printf("publisher error: %v", err)
+		return
+	}
+
+	for _, slug := range published {
+		log.Printf("published scheduled post %s", slug)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// AccessTokenTTL is how long an access token of the API can be used, a leaked token is only useful for a short while
+// Clients get a new access token with their refresh token
+var AccessTokenTTL = 15 * time.Minute
+
+// RefreshTokenTTL is how long a refresh token can be used. Every refresh returns a new refresh token, so clients which
+// are used regularly stay logged in
+var RefreshTokenTTL = 30 * 24 * time.Hour
+
+// errInvalidRefreshToken is returned for refresh tokens which can't be used
+var errInvalidRefreshToken = errors.New("the refresh token is invalid or has expired, log in again")
+
+// issueAPITokens creates an access token and a refresh token for a user who logged in or refreshed the tokens
+// family is the family of the refresh token which was exchanged, a new login starts a new family
+func (s *Server) issueAPITokens(user models.User, family string) (authenticationResponse, error) {
+	now := time.Now()
+
+	// The role is informative, permissions are checked with the stored role
+	expires := now.Add(AccessTokenTTL)
+	token, err := s.CreateToken(map[string]interface{}{"activeUser": user.Username, "role": user.Role}, expires.Unix())
+	if err != nil {
+		return authenticationResponse{}, err
+	}
+
+	if family == "" {
+		if family, err = newTokenID(); err != nil {
+			return authenticationResponse{}, err
+		}
+	}
+
+	// The refresh token is random like a password reset token, only its hash is stored
+	refreshToken, hash, err := newToken()
+	if err != nil {
+		return authenticationResponse{}, err
+	}
+	err = s.db.CreateRefreshToken(models.RefreshToken{
+		TokenHash: hash,
+		UserID:    user.ID,
+		Family:    family,
+		Created:   now,
+		Expires:   now.Add(RefreshTokenTTL),
+	})
+	if err != nil {
+		return authenticationResponse{}, err
+	}
+
+	return authenticationResponse{Token: token, RefreshToken: refreshToken, ExpiresIn: int64(AccessTokenTTL / time.Second)}, nil
+}
+
+// refreshAPITokens exchanges a refresh token for a new access token and a new refresh token, the old refresh token
+// can't be used again. Using it again anyway means it was stolen, or the new one was, so the whole family is revoked
+// and the user has to log in again
+// Returns the new tokens, or the HTTP status and the error which prevented the refresh
+func (s *Server) refreshAPITokens(refreshToken string) (authenticationResponse, int, error) {
+	t, err := s.db.UseRefreshToken(hashToken(refreshToken), time.Now())
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return authenticationResponse{}, http.StatusUnauthorized, errInvalidRefreshToken
+		case database.ErrRefreshTokenUsed:
+			log.Printf("refresh token of user %d was used again, revoking its family", t.UserID)
+			if err := s.db.RevokeRefreshTokens(t.Family); err != nil {
+				return authenticationResponse{}, http.StatusInternalServerError, err
+			}
+			return authenticationResponse{}, http.StatusUnauthorized, errInvalidRefreshToken
+		}
+		return authenticationResponse{}, http.StatusInternalServerError, err
+	}
+
+	// The account may have been changed since the login
+	user, err := s.db.GetUserByID(t.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return authenticationResponse{}, http.StatusUnauthorized, errInvalidRefreshToken
+		}
+		return authenticationResponse{}, http.StatusInternalServerError, err
+	}
+	if !user.Active() {
+		if err := s.db.RevokeRefreshTokens(t.Family); err != nil {
+			return authenticationResponse{}, http.StatusInternalServerError, err
+		}
+		return authenticationResponse{}, http.StatusUnauthorized, errors.New(inactiveReason(user))
+	}
+
+	tokens, err := s.issueAPITokens(user, t.Family)
+	if err != nil {
+		return authenticationResponse{}, http.StatusInternalServerError, err
+	}
+	return tokens, http.StatusOK, nil
+}
+
+// logoutAPI revokes the access token with the provided claims and the refresh token, either may be missing
+// An access token which isn't sent along stays valid until it expires, which doesn't take long
+// Returns the HTTP status and the error which prevented the logout
+func (s *Server) logoutAPI(claims *Claims, refreshToken string) (int, error) {
+	if claims == nil && refreshToken == "" {
+		return http.StatusBadRequest, errors.New("send the access token or the refresh token to log out")
+	}
+
+	if claims != nil && claims.Id != "" {
+		if err := s.db.RevokeToken(claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if refreshToken != "" {
+		// Using the token finds its family, the token and the tokens it replaced are deleted afterwards.
+		// Logging out twice does no harm
+		t, err := s.db.UseRefreshToken(hashToken(refreshToken), time.Now())
+		if err != nil && err != database.ErrRefreshTokenUsed {
+			if err == sql.ErrNoRows {
+				return http.StatusOK, nil
+			}
+			return http.StatusInternalServerError, err
+		}
+		if err := s.db.RevokeRefreshTokens(t.Family); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestRefreshTokenReuse uses a refresh token again after it was exchanged, which has to revoke every token of its
+// family. Tokens of another login of the same user stay valid
+func TestRefreshTokenReuse(t *testing.T) {
+	tests := []struct {
+		name  string
+		reuse int
+	}{
+		{"first token", 0},
+		{"middle token", 1},
+		{"token before the newest", 2},
+	}
+
+	for _, tt := range tests {
+		for name, store := range testStores(t) {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServer(t)
+				s.db = store
+				user := createTestUser(t, s, "alice", "author")
+
+				other, err := s.issueAPITokens(user, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Refresh a few times, every refresh token is only valid once
+				first, err := s.issueAPITokens(user, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				chain := []string{first.RefreshToken}
+				for i := 0; i < 3; i++ {
+					tokens, status, err := s.refreshAPITokens(chain[len(chain)-1])
+					if status != http.StatusOK {
+						t.Fatalf("refresh %d: %d %v", i+1, status, err)
+					}
+					chain = append(chain, tokens.RefreshToken)
+				}
+
+				if _, status, _ := s.refreshAPITokens(chain[tt.reuse]); status != http.StatusUnauthorized {
+					t.Fatalf("reused token: got status %d, want %d", status, http.StatusUnauthorized)
+				}
+
+				// The newest token hasn't been used, but belongs to the revoked family
+				if _, status, _ := s.refreshAPITokens(chain[len(chain)-1]); status != http.StatusUnauthorized {
+					t.Errorf("newest token: got status %d, want %d", status, http.StatusUnauthorized)
+				}
+
+				if _, status, err := s.refreshAPITokens(other.RefreshToken); status != http.StatusOK {
+					t.Errorf("token of another login: got %d %v, want %d", status, err, http.StatusOK)
+				}
+			})
+		}
+	}
+}
+
+func TestRefreshTokenInvalid(t *testing.T) {
+	s := newTestServer(t)
+
+	if _, status, _ := s.refreshAPITokens("not-a-token"); status != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
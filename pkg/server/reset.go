@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/mailer"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// PasswordResetTTL is how long a password reset link can be used
+var PasswordResetTTL = time.Hour
+
+// newToken creates a random token to send to a user, and the hash of the token to store
+// Only the hash is stored, so the tokens can't be used by whoever gets hold of the database
+func newToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken hashes a token created by newToken
+// The tokens are random and long, so a fast hash is enough, unlike for passwords
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestPasswordReset sends password reset links to the user with the username, or to the users with the email address
+// Nothing tells whether an account was found, that would reveal who has an account. Users without an email address
+// and disabled users don't get a link
+func (s *Server) requestPasswordReset(username, email string) error {
+	var users []models.User
+	if username != "" {
+		user, err := s.db.GetUserByUsername(username)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			users = append(users, user)
+		}
+	} else {
+		var err error
+		if users, err = s.db.GetUsersByEmail(email); err != nil {
+			return err
+		}
+	}
+
+	for _, user := range users {
+		if user.Email == "" || user.Disabled {
+			continue
+		}
+
+		token, hash, err := newToken()
+		if err != nil {
+			return err
+		}
+		if err := s.db.CreatePasswordResetToken(user.ID, hash, time.Now().Add(PasswordResetTTL)); err != nil {
+			return err
+		}
+
+		msg := mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your Go Blog! password",
+			Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account %s. "+
+				"Choose a new password within %v at:\n\n%s\n\nIf it wasn't you, ignore this email and your password stays the same.\n",
+				displayName(user), user.Username, PasswordResetTTL, strings.TrimSuffix(s.BaseURL, "/")+"/reset/"+token),
+		}
+		if err := s.Mailer.Send(msg); err != nil {
+			// Sending to one user failing shouldn't stop sending to the others
+			log.Printf("couldn't send password reset email to %s: %v", user.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// passwordResetUser gets the user a password reset token was sent to, to show who the new password is for
+// Returns the HTTP status and an error if the token can't be used
+func (s *Server) passwordResetUser(token string) (models.User, int, error) {
+	user, err := s.db.GetPasswordResetUser(hashToken(token), time.Now())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, fmt.Errorf("the password reset link is invalid or has expired")
+		}
+		return user, http.StatusInternalServerError, err
+	}
+	if user.Disabled {
+		return user, http.StatusForbidden, errors.New(inactiveReason(user))
+	}
+
+	return user, http.StatusOK, nil
+}
+
+// resetPassword uses a password reset token to set a new password, the token can't be used again
+// Returns the user, or the HTTP status and the error which prevented the reset
+func (s *Server) resetPassword(token, password string) (models.User, int, error) {
+	user, status, err := s.passwordResetUser(token)
+	if err != nil {
+		return user, status, err
+	}
+
+	// Check the password before the token is used up, so the user can try again
+	if err := models.ValidatePassword(password, user.Username); err != nil {
+		return user, http.StatusBadRequest, err
+	}
+
+	if user, err = s.db.UsePasswordResetToken(hashToken(token), time.Now()); err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, fmt.Errorf("the password reset link is invalid or has expired")
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	// The new password is hashed with bcrypt like every password, it also ends a forced password reset
+	if user, err = s.db.UpdateUser(user, password); err != nil {
+		return user, http.StatusInternalServerError, err
+	}
+
+	// A lockout of the username would keep the user from logging in with the new password
+	s.loginSucceeded(user.Username)
+
+	return user, http.StatusOK, nil
+}
+
+// displayName returns the name of a user, or the username if the user has no name
+func displayName(user models.User) string {
+	if user.Name != "" {
+		return user.Name
+	}
+	return user.Username
+}
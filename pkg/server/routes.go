@@ -3,6 +3,7 @@ package server
 import (
 	"net/http"
 
+	"github.com/golangbg/web-api-development-demo/pkg/models"
 	"github.com/gorilla/mux"
 )
 
@@ -15,9 +16,21 @@ func (s *Server) Routes() *mux.Router {
 	/**** API routes *****/
 	// Authentication
 	r.HandleFunc("/api/auth", s.userAuthenticateAPIHandler).Methods(http.MethodPost)
+	// Second step of the authentication for users with two-factor authentication
+	r.HandleFunc("/api/auth/mfa", s.userMFAAPIHandler).Methods(http.MethodPost)
 
-	// Create post
-	r.HandleFunc("/api/post", s.ReqToken(s.postCreateUpdateAPIHandler)).Methods(http.MethodPost)
+	// Exchange a refresh token for new tokens, and revoke the tokens when logging out
+	r.HandleFunc("/api/auth/refresh", s.userRefreshAPIHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/auth/logout", s.userLogoutAPIHandler).Methods(http.MethodPost)
+
+	// The public keys tokens are verified with, for other services
+	r.HandleFunc("/.well-known/jwks.json", s.jwksHandler).Methods(http.MethodGet)
+
+	// Setup the URL for sending a password reset link, the link opens the web form for choosing a new password
+	r.HandleFunc("/api/password-reset", s.passwordResetAPIHandler).Methods(http.MethodPost)
+
+	// Create post, readers may only comment
+	r.HandleFunc("/api/post", s.ReqToken(s.RequirePermission(models.PermWritePosts)(s.postCreateAPIHandler))).Methods(http.MethodPost)
 
 	// Read all posts
 	r.HandleFunc("/api/post", s.postsGetAPIHandler).Methods(http.MethodGet)
@@ -25,7 +38,54 @@ func (s *Server) Routes() *mux.Router {
 	r.HandleFunc("/api/post/{slug}", s.postGetAPIHandler).Methods(http.MethodGet)
 
 	// Update post
-	r.HandleFunc("/api/post/{slug}", s.ReqToken(s.postCreateUpdateAPIHandler)).Methods(http.MethodPut)
+	r.HandleFunc("/api/post/{slug}", s.ReqToken(s.postUpdateAPIHandler)).Methods(http.MethodPut)
+
+	// Delete post
+	r.HandleFunc("/api/post/{slug}", s.ReqToken(s.postDeleteAPIHandler)).Methods(http.MethodDelete)
+
+	// Read the history of a post
+	r.HandleFunc("/api/post/{slug}/revisions", s.ReqToken(s.postRevisionsAPIHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/post/{slug}/revisions/diff", s.ReqToken(s.postDiffAPIHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/post/{slug}/revisions/{id:[0-9]+}", s.ReqToken(s.postRevisionAPIHandler)).Methods(http.MethodGet)
+
+	// Restore a post to a revision
+	r.HandleFunc("/api/post/{slug}/revisions/{id:[0-9]+}/restore", s.ReqToken(s.postRestoreAPIHandler)).Methods(http.MethodPost)
+
+	// Read and add the comments on a post, a token is optional for adding a comment
+	r.HandleFunc("/api/post/{slug}/comments", s.postCommentsAPIHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/post/{slug}/comments", s.postCommentCreateAPIHandler).Methods(http.MethodPost)
+
+	// Moderate a comment on a post
+	r.HandleFunc("/api/post/{slug}/comments/{id:[0-9]+}/{action:approve|reject|spam}", s.ReqToken(s.postCommentModerateAPIHandler)).Methods(http.MethodPost)
+
+	// Read all tags
+	r.HandleFunc("/api/tag", s.tagsGetAPIHandler).Methods(http.MethodGet)
+
+	// Search posts
+	r.HandleFunc("/api/search", s.searchAPIHandler).Methods(http.MethodGet)
+
+	// Read and change the own account
+	r.HandleFunc("/api/me", s.ReqToken(s.meGetAPIHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/api/me", s.ReqToken(s.meUpdateAPIHandler)).Methods(http.MethodPut)
+	r.HandleFunc("/api/me/verification", s.ReqToken(s.meVerificationAPIHandler)).Methods(http.MethodPost)
+
+	// Setup the URLs for enabling and disabling two-factor authentication of the authenticated user
+	r.HandleFunc("/api/me/totp", s.ReqToken(s.meTOTPCreateAPIHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/api/me/totp", s.ReqToken(s.meTOTPDeleteAPIHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/me/totp/confirm", s.ReqToken(s.meTOTPConfirmAPIHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/api/me/totp/recovery-codes", s.ReqToken(s.meRecoveryCodesAPIHandler)).Methods(http.MethodPost)
+
+	// Manage users, only for admins
+	admin := s.RequirePermission(models.PermManageUsers)
+	r.HandleFunc("/api/user", s.ReqToken(admin(s.usersGetAPIHandler))).Methods(http.MethodGet)
+	r.HandleFunc("/api/user/{username}", s.ReqToken(admin(s.userGetAPIHandler))).Methods(http.MethodGet)
+	r.HandleFunc("/api/user/{username}", s.ReqToken(admin(s.userUpdateAPIHandler))).Methods(http.MethodPut)
+	r.HandleFunc("/api/user/{username}", s.ReqToken(admin(s.userDeleteAPIHandler))).Methods(http.MethodDelete)
+	r.HandleFunc("/api/user/{username}/verification", s.ReqToken(admin(s.userVerificationAPIHandler))).Methods(http.MethodPost)
+
+	// See and lift the lockouts after failed logins, only for admins
+	r.HandleFunc("/api/locks", s.ReqToken(admin(s.locksGetAPIHandler))).Methods(http.MethodGet)
+	r.HandleFunc("/api/locks/{kind}/{value}", s.ReqToken(admin(s.lockDeleteAPIHandler))).Methods(http.MethodDelete)
 
 	/**** Web routes ****/
 	// Serve the static files directory (http://www.gorillatoolkit.org/pkg/mux)
@@ -34,6 +94,17 @@ func (s *Server) Routes() *mux.Router {
 	// Setup the root URL
 	r.HandleFunc("/", s.rootHandler("templates/main.html", "templates/root.html"))
 
+	// Setup the URLs for the yearly and monthly archives
+	archive := s.archiveHandler("templates/main.html", "templates/root.html")
+	r.HandleFunc("/archive/{year:[0-9]{4}}", archive).Methods(http.MethodGet)
+	r.HandleFunc("/archive/{year:[0-9]{4}}/{month:[0-9]{2}}", archive).Methods(http.MethodGet)
+
+	// Setup the URL for the posts with a tag
+	r.HandleFunc("/tag/{name}", s.tagHandler("templates/main.html", "templates/root.html")).Methods(http.MethodGet)
+
+	// Setup the URL for searching posts
+	r.HandleFunc("/search", s.searchHandler("templates/main.html", "templates/search.html")).Methods(http.MethodGet)
+
 	// Setup the URL for registering new users
 	r.HandleFunc("/register", s.userCreateHandler("templates/main.html", "templates/register.html")).Methods(http.MethodGet)
 
@@ -46,14 +117,81 @@ func (s *Server) Routes() *mux.Router {
 	// Setup the URL for authenticating a user
 	r.HandleFunc("/login", s.userAuthenticateHandler).Methods(http.MethodPost)
 
+	// Setup the URLs for choosing a new password after an admin forced a password reset
+	r.HandleFunc("/login/password", s.userPasswordResetHandler("templates/main.html", "templates/password.html")).Methods(http.MethodGet)
+	r.HandleFunc("/login/password", s.userPasswordResetSaveHandler).Methods(http.MethodPost)
+
+	// Setup the URLs for entering the second factor after the password, for users with two-factor authentication
+	r.HandleFunc("/login/mfa", s.userMFAHandler("templates/main.html", "templates/mfa.html")).Methods(http.MethodGet)
+	r.HandleFunc("/login/mfa", s.userMFASaveHandler).Methods(http.MethodPost)
+
+	// Setup the URLs for asking a password reset link, and for choosing a new password with it
+	r.HandleFunc("/reset", s.passwordResetRequestHandler("templates/main.html", "templates/reset.html")).Methods(http.MethodGet)
+	r.HandleFunc("/reset", s.passwordResetRequestSaveHandler).Methods(http.MethodPost)
+	r.HandleFunc("/reset/{token}", s.passwordResetHandler("templates/main.html", "templates/password.html")).Methods(http.MethodGet)
+	r.HandleFunc("/reset/{token}", s.passwordResetSaveHandler).Methods(http.MethodPost)
+
+	// Setup the URL of the links which verify email addresses
+	r.HandleFunc("/verify/{token}", s.verifyEmailHandler).Methods(http.MethodGet)
+
 	// Setup the URL for user logout
 	r.HandleFunc("/logout", s.ReqAuth(s.userLogoutHandler))
 
-	// Setup the URL for creating a new post
-	r.HandleFunc("/new", s.ReqAuth(s.postCreateHandler("templates/main.html", "templates/create.html"))).Methods(http.MethodGet)
+	// Setup the URLs for changing the own name, email address and password, and for a new verification link
+	r.HandleFunc("/profile", s.ReqAuth(s.profileHandler("templates/main.html", "templates/profile.html"))).Methods(http.MethodGet)
+	r.HandleFunc("/profile", s.ReqAuth(s.profileSaveHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/profile/password", s.ReqAuth(s.profilePasswordHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/profile/verification", s.ReqAuth(s.profileVerificationHandler)).Methods(http.MethodPost)
+
+	// Setup the URLs for enabling and disabling two-factor authentication
+	r.HandleFunc("/profile/totp", s.ReqAuth(s.profileTOTPHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/profile/totp/qr.png", s.ReqAuth(s.profileTOTPQRCodeHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/profile/totp/recovery-codes", s.ReqAuth(s.profileRecoveryCodesHandler("templates/main.html", "templates/recovery.html"))).Methods(http.MethodPost)
+	r.HandleFunc("/profile/totp/disable", s.ReqAuth(s.profileTOTPDisableHandler)).Methods(http.MethodPost)
+
+	// Setup the URLs for managing users, only for admins
+	r.HandleFunc("/admin/users", s.ReqAuth(admin(s.usersAdminHandler("templates/main.html", "templates/users.html")))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/users/{username}", s.ReqAuth(admin(s.userAdminSaveHandler))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{username}/delete", s.ReqAuth(admin(s.userAdminDeleteHandler))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{username}/verification", s.ReqAuth(admin(s.userAdminVerificationHandler))).Methods(http.MethodPost)
+
+	// Setup the URLs for seeing and lifting the lockouts after failed logins, only for admins
+	r.HandleFunc("/admin/locks", s.ReqAuth(admin(s.locksAdminHandler("templates/main.html", "templates/locks.html")))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/locks/{kind}/{value}/clear", s.ReqAuth(admin(s.lockAdminClearHandler))).Methods(http.MethodPost)
+
+	// Setup the URL for creating a new post, only for users whose role allows writing posts
+	writer := s.RequirePermission(models.PermWritePosts)
+	r.HandleFunc("/new", s.ReqAuth(writer(s.postCreateHandler("templates/main.html", "templates/create.html")))).Methods(http.MethodGet)
 
 	// Setup the URL for saving a post. Should listen only to POST requests, we do so by using Methods
-	r.HandleFunc("/new", s.ReqAuth(s.postSaveHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/new", s.ReqAuth(writer(s.postSaveHandler))).Methods(http.MethodPost)
+
+	// Setup the URL for editing a post
+	r.HandleFunc("/{slug}/edit", s.ReqAuth(s.postEditHandler("templates/main.html", "templates/create.html"))).Methods(http.MethodGet)
+
+	// Setup the URL for saving the changes to a post
+	r.HandleFunc("/{slug}/edit", s.ReqAuth(s.postUpdateHandler)).Methods(http.MethodPost)
+
+	// Setup the URL for confirming the deletion of a post
+	r.HandleFunc("/{slug}/delete", s.ReqAuth(s.postDeleteConfirmHandler("templates/main.html", "templates/delete.html"))).Methods(http.MethodGet)
+
+	// Setup the URL for deleting a post
+	r.HandleFunc("/{slug}/delete", s.ReqAuth(s.postDeleteHandler)).Methods(http.MethodPost)
+
+	// Setup the URL for the history of a post
+	r.HandleFunc("/{slug}/history", s.ReqAuth(s.postHistoryHandler("templates/main.html", "templates/history.html"))).Methods(http.MethodGet)
+
+	// Setup the URL for restoring a post to a revision
+	r.HandleFunc("/{slug}/history/{id:[0-9]+}/restore", s.ReqAuth(s.postRestoreHandler)).Methods(http.MethodPost)
+
+	// Setup the URL for commenting on a post, anonymous visitors can comment as well
+	r.HandleFunc("/{slug}/comments", s.commentSaveHandler).Methods(http.MethodPost)
+
+	// Setup the URL for moderating the comments on a post
+	r.HandleFunc("/{slug}/moderate", s.ReqAuth(s.commentModerationHandler("templates/main.html", "templates/moderate.html"))).Methods(http.MethodGet)
+
+	// Setup the URL for approving or rejecting a comment, or marking it as spam
+	r.HandleFunc("/{slug}/moderate/{id:[0-9]+}/{action:approve|reject|spam}", s.ReqAuth(s.commentModerateHandler)).Methods(http.MethodPost)
 
 	// This one needs to be last
 	// Setup the URL for getting a single post, takes the slug as a parameter (http://www.gorillatoolkit.org/pkg/mux)
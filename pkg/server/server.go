@@ -5,10 +5,13 @@ import (
 	"encoding/gob"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/golangbg/web-api-development-demo/pkg/database"
+	"github.com/golangbg/web-api-development-demo/pkg/mailer"
 	"github.com/golangbg/web-api-development-demo/pkg/models"
 	"github.com/gorilla/sessions"
 )
@@ -26,7 +29,35 @@ type Server struct {
 	// store provides cookie and filesystem sessions and infrastructure for custom session backends
 	// http://www.gorillatoolkit.org/pkg/sessions
 	store *sessions.CookieStore
-	db    *database.DB
+	db    database.Store
+
+	// keys contains the keys JWT tokens are signed and verified with
+	// The public keys are served at /.well-known/jwks.json, so other services can verify the tokens
+	keys *KeyRing
+
+	// SpamScorer scores new comments, replace it to plug in another spam filter
+	SpamScorer models.SpamScorer
+
+	// Mailer sends the emails, like password reset links. By default they are only logged
+	Mailer mailer.Mailer
+	// BaseURL is the address the blog is reached at, like https://blog.example.com. It's used for links in emails,
+	// which can't be taken from the request because clients control the Host header
+	BaseURL string
+	// TrustedProxies are the reverse proxies the blog runs behind, see remoteIP. Without them the X-Forwarded-For header
+	// is ignored, so behind a proxy every client would share the address of the proxy and its login throttle
+	TrustedProxies []*net.IPNet
+
+	// The publisher publishes scheduled posts in the background, see publisher.go
+	publisherMu   sync.Mutex
+	stopPublisher chan struct{}
+	publisherDone chan struct{}
+}
+
+// ListenAndServe starts the publisher and then listens on the server's address
+// It replaces the ListenAndServe method of the embedded http.Server, Close stops the publisher again
+func (s *Server) ListenAndServe() error {
+	s.startPublisher()
+	return s.Server.ListenAndServe()
 }
 
 // Close contains all the steps for a graceful shutdown of the server
@@ -36,6 +67,9 @@ func (s *Server) Close() {
 		log.Printf("could shutdown HTTP server: %v", err)
 	}
 
+	// Stop the publisher before the database is closed
+	s.haltPublisher()
+
 	// Close the database
 	if err := s.db.CloseDB(); err != nil {
 		log.Printf("could close DB: %v", err)
@@ -61,14 +95,88 @@ func (s *Server) PrepareData(w http.ResponseWriter, r *http.Request, data map[st
 	if activeUser, ok := session.Values["activeUser"]; ok {
 		data["ActiveUser"] = activeUser
 	}
+
+	// Check if the session has an active user ID, if so pass it via data
+	if activeUserID, ok := session.Values["activeUserID"]; ok {
+		data["ActiveUserID"] = activeUserID
+	}
+
+	// Check if the session has the role of the active user, if so pass it and what it allows via data
+	if role, ok := session.Values["activeUserRole"].(string); ok {
+		data["ActiveUserRole"] = role
+		data["CanWritePosts"] = models.RoleHasPermission(role, models.PermWritePosts)
+		data["CanManageUsers"] = models.RoleHasPermission(role, models.PermManageUsers)
+	}
+}
+
+// activeUserID returns the ID of the logged in user, or 0 if nobody is logged in
+func (s *Server) activeUserID(r *http.Request) int64 {
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		return 0
+	}
+
+	id, _ := session.Values["activeUserID"].(int64)
+	return id
+}
+
+// activeUser returns the logged in user, or an empty user if nobody is logged in or the user isn't active anymore
+// The user is read from the database, so its role and account state are always the current ones
+func (s *Server) activeUser(r *http.Request) models.User {
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		return models.User{}
+	}
+
+	username, ok := session.Values["activeUser"].(string)
+	if !ok {
+		return models.User{}
+	}
+
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil || !user.Active() {
+		return models.User{}
+	}
+	return user
+}
+
+// defaultBaseURL returns the address of a blog listening on addr, for when no BaseURL is configured
+func defaultBaseURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://localhost"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
 }
 
 // New initializes and returns a pointer to a custom server (https://gobyexample.com/pointers)
-func New(addr string) (*Server, error) {
+// The server uses the SQLite database goblog.db for storage, and signs tokens with the provided keys
+func New(addr string, keys *KeyRing) (*Server, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("no keys are set")
+	}
+
 	db, err := database.New("goblog.db")
 	if err != nil {
 		return nil, fmt.Errorf("database error: %v", err)
 	}
+
+	return NewWithStore(addr, db, keys)
+}
+
+// NewWithStore initializes and returns a pointer to a custom server which uses the provided store and keys
+// This allows running the server on another backend, for example database.NewMemory() with the keys of NewKeyRing
+func NewWithStore(addr string, db database.Store, keys *KeyRing) (*Server, error) {
+	if db == nil {
+		return nil, fmt.Errorf("no store is set")
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("no keys are set")
+	}
+
 	// Create custom server
 	srv := &Server{
 		Server: http.Server{
@@ -76,8 +184,12 @@ func New(addr string) (*Server, error) {
 			ReadTimeout:  10 * time.Second,
 			WriteTimeout: 10 * time.Second,
 		},
-		store: sessions.NewCookieStore([]byte("something-very-secret")),
-		db:    db,
+		store:      sessions.NewCookieStore([]byte("something-very-secret")),
+		db:         db,
+		keys:       keys,
+		SpamScorer: models.NewHeuristicScorer(),
+		Mailer:     mailer.LogMailer{},
+		BaseURL:    defaultBaseURL(addr),
 	}
 
 	// Connect the server's handler with the routes
@@ -88,8 +200,9 @@ func New(addr string) (*Server, error) {
 
 // init is used for one-time actions (https://medium.com/golangspec/init-functions-in-go-eac191b3860a)
 func init() {
-	// Sessions uses gob for encoding/decoring. Therefore we need to register our post and user model once, so that
-	// we can use it in sessions (https://golang.org/pkg/encoding/gob/)
+	// Sessions uses gob for encoding/decoring. Therefore we need to register our post, user and comment model once,
+	// so that we can use it in sessions (https://golang.org/pkg/encoding/gob/)
 	gob.Register(&models.Post{})
 	gob.Register(&models.User{})
+	gob.Register(&models.Comment{})
 }
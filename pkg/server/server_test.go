@@ -0,0 +1,65 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+	"github.com/golangbg/web-api-development-demo/pkg/mailer"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// newTestServer returns a server on the in-memory store, with a signing key which is only kept in memory
+// The routes aren't set up because they load the templates, tests call the handlers directly
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	keys, err := NewKeyRing(AlgEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{
+		db:         database.NewMemory(),
+		keys:       keys,
+		SpamScorer: models.NewHeuristicScorer(),
+		Mailer:     mailer.LogMailer{},
+	}
+}
+
+// createTestUser stores a user with the role, who can publish, and returns it
+func createTestUser(t *testing.T, s *Server, username, role string) models.User {
+	t.Helper()
+
+	user, err := s.db.CreateUser(models.User{Username: username, Name: username, Role: role, EmailVerified: true}, "correct-horse-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// testToken returns an access token for the user, like a login would
+func testToken(t *testing.T, s *Server, user models.User) string {
+	t.Helper()
+
+	token, err := s.CreateToken(map[string]interface{}{"activeUser": user.Username, "role": user.Role}, time.Now().Add(time.Minute).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testStores returns an in-memory store and an SQLite store in a temporary directory, for tests which should pass
+// with both
+func testStores(t *testing.T) map[string]database.Store {
+	t.Helper()
+
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.CloseDB() })
+
+	return map[string]database.Store{"memory": database.NewMemory(), "sqlite": db}
+}
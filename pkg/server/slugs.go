@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// defaultSlug is the base of generated slugs for titles without letters or digits
+const defaultSlug = "post"
+
+// newPostSlug returns the slug for a new post
+// A requested slug is brought into its canonical form, otherwise a free slug is generated from the title
+// Returns an empty slug for an empty title, validation reports the missing title
+// Returns a models.ValidationError if the slug breaks the rules of models.ValidateSlug
+func (s *Server) newPostSlug(requested, title string) (string, error) {
+	if requested != "" {
+		slug := models.Slugify(requested)
+		return slug, models.ValidateSlug(slug)
+	}
+	if title == "" {
+		return "", nil
+	}
+
+	base := models.Slugify(title)
+	if base == "" {
+		base = defaultSlug
+	}
+	slug, err := s.db.AvailableSlug(base)
+	if err != nil {
+		return "", err
+	}
+	return slug, models.ValidateSlug(slug)
+}
+
+// editedPostSlug returns the slug of an existing post after an edit which sent the requested slug
+// An empty or unchanged slug keeps the stored slug as it is, even if it's from before the slug rules. A new slug is
+// brought into its canonical form and renames the post
+// Returns a models.ValidationError if the new slug breaks the rules of models.ValidateSlug
+func editedPostSlug(existing, requested string) (string, error) {
+	if requested == "" || requested == existing {
+		return existing, nil
+	}
+
+	slug := models.Slugify(requested)
+	if slug == "" || slug == existing {
+		return existing, nil
+	}
+	return slug, models.ValidateSlug(slug)
+}
+
+// movedPostSlug returns the slug a renamed post can be found at now
+// Returns false if the slug wasn't renamed, or if the viewer isn't allowed to read the post
+func (s *Server) movedPostSlug(slug string, viewer int64) (string, bool) {
+	newSlug, err := s.db.GetSlugRedirect(slug)
+	if err != nil {
+		return "", false
+	}
+
+	if _, err := s.db.GetPostBySlug(newSlug, viewer); err != nil {
+		return "", false
+	}
+	return newSlug, true
+}
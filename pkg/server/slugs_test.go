@@ -0,0 +1,95 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+func TestEditedPostSlug(t *testing.T) {
+	tests := []struct {
+		existing, requested string
+		want                string
+		wantErr             bool
+	}{
+		// Legacy slugs from before the slug rules are kept when they aren't changed
+		{"Hello-World", "", "Hello-World", false},
+		{"Hello-World", "Hello-World", "Hello-World", false},
+		{"My_First_Post", "My_First_Post", "My_First_Post", false},
+		// New slugs are canonicalized and validated
+		{"Hello-World", "Hello World!", "hello-world", false},
+		{"hello", "Hello", "hello", false},
+		{"hello", "new", "", true},
+		{"hello", "!!!", "hello", false},
+	}
+
+	for _, tt := range tests {
+		got, err := editedPostSlug(tt.existing, tt.requested)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("editedPostSlug(%q, %q) error = %v, want error %v", tt.existing, tt.requested, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("editedPostSlug(%q, %q) = %q, want %q", tt.existing, tt.requested, got, tt.want)
+		}
+	}
+}
+
+// TestEditLegacySlug edits and restores a post with a slug from before the slug rules, through the API
+// The slug has to stay as it is, without a redirect
+func TestEditLegacySlug(t *testing.T) {
+	s := newTestServer(t)
+	user := createTestUser(t, s, "bob", models.RoleAuthor)
+	token := testToken(t, s, user)
+
+	const slug = "Hello-World"
+	if _, err := s.db.CreatePost(models.Post{Slug: slug, UserID: user.ID, Title: "Hello", Markdown: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"title": "Edited", "markdown": "second"}`,
+		`{"title": "Edited again", "markdown": "third", "slug": "Hello-World"}`,
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/api/post/"+slug, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r = mux.SetURLVars(r, map[string]string{"slug": slug})
+		w := httptest.NewRecorder()
+		s.postUpdateAPIHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("updating with %s: got status %d: %s", body, w.Code, w.Body)
+		}
+	}
+
+	revisions, err := s.db.GetRevisions(slug)
+	if err != nil || len(revisions) == 0 {
+		t.Fatalf("got %d revisions, error %v", len(revisions), err)
+	}
+	first := revisions[len(revisions)-1]
+
+	r := httptest.NewRequest(http.MethodPost, "/api/post/"+slug+"/revisions/restore", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r = mux.SetURLVars(r, map[string]string{"slug": slug, "id": fmt.Sprint(first.ID)})
+	w := httptest.NewRecorder()
+	s.postRestoreAPIHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("restoring: got status %d: %s", w.Code, w.Body)
+	}
+
+	post, err := s.db.GetPostBySlug(slug, models.ViewAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.Markdown != "first" {
+		t.Errorf("got markdown %q after restoring, want %q", post.Markdown, "first")
+	}
+	if _, err := s.db.GetSlugRedirect(slug); err != sql.ErrNoRows {
+		t.Errorf("got a redirect from %s, error %v", slug, err)
+	}
+}
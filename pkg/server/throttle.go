@@ -0,0 +1,153 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// ThrottlePolicy decides how long logins are locked out after a number of failed logins
+// The lockout doubles with every failure, so guessing passwords gets slow quickly while typos cost little
+type ThrottlePolicy struct {
+	// FreeFailures is the number of failed logins before logins are locked out
+	FreeFailures int
+	// BaseLockout is the lockout after the first failure beyond FreeFailures
+	BaseLockout time.Duration
+	// MaxLockout is the longest lockout, so users are never locked out for good
+	MaxLockout time.Duration
+}
+
+// Lockout returns how long logins are locked out after the provided number of failed logins, 0 if they aren't
+func (p ThrottlePolicy) Lockout(failures int) time.Duration {
+	n := failures - p.FreeFailures
+	if n <= 0 {
+		return 0
+	}
+
+	d := p.BaseLockout
+	for i := 1; i < n && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return d
+}
+
+var (
+	// UsernameThrottle limits the failed logins per username, whether the user exists or not
+	// Anybody can lock out a user with it for a while, so the lockouts are kept short
+	UsernameThrottle = ThrottlePolicy{FreeFailures: 5, BaseLockout: 30 * time.Second, MaxLockout: 15 * time.Minute}
+	// IPThrottle limits the failed logins per IP address, which stops guessing the passwords of many users
+	// Many users may share an address, so it allows more failures
+	IPThrottle = ThrottlePolicy{FreeFailures: 20, BaseLockout: 30 * time.Second, MaxLockout: time.Hour}
+	// ThrottleWindow is how long failed logins are counted, older failures are forgotten
+	// It has to be longer than the lockouts, or the lockouts wouldn't grow
+	ThrottleWindow = 24 * time.Hour
+)
+
+// loginThrottle is a login throttle which applies to a login, with its policy
+type loginThrottle struct {
+	kind, value string
+	policy      ThrottlePolicy
+}
+
+// loginThrottles returns the throttles which apply to logins as username from ip
+// Usernames are counted in lower case, because they are unique regardless of case
+func loginThrottles(username, ip string) []loginThrottle {
+	throttles := []loginThrottle{{models.ThrottleIP, ip, IPThrottle}}
+	if username = strings.ToLower(strings.TrimSpace(username)); username != "" {
+		throttles = append(throttles, loginThrottle{models.ThrottleUsername, username, UsernameThrottle})
+	}
+	return throttles
+}
+
+// loginRetryAfter returns how long logins as username from ip are locked out, 0 if they are allowed
+func (s *Server) loginRetryAfter(username, ip string) (time.Duration, error) {
+	now := time.Now()
+
+	var wait time.Duration
+	for _, lt := range loginThrottles(username, ip) {
+		t, err := s.db.GetLoginThrottle(lt.kind, lt.value)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if d := t.RetryAfter(now); d > wait {
+			wait = d
+		}
+	}
+
+	return wait, nil
+}
+
+// loginFailed counts a failed login as username from ip, and locks out further logins when there were too many
+// Logins are refused while they are locked out, even with the right password, so those attempts aren't counted
+func (s *Server) loginFailed(username, ip string) {
+	now := time.Now()
+
+	for _, lt := range loginThrottles(username, ip) {
+		t, err := s.db.RecordLoginFailure(lt.kind, lt.value, now, now.Add(-ThrottleWindow))
+		if err != nil {
+			log.Printf("couldn't record failed login of %s %s: %v", lt.kind, lt.value, err)
+			continue
+		}
+
+		if lockout := lt.policy.Lockout(t.Failures); lockout > 0 {
+			log.Printf("locking out logins of %s %s for %v after %d failed logins", lt.kind, lt.value, lockout, t.Failures)
+			if err := s.db.LockLogins(lt.kind, lt.value, now.Add(lockout)); err != nil {
+				log.Printf("couldn't lock out logins of %s %s: %v", lt.kind, lt.value, err)
+			}
+		}
+	}
+}
+
+// loginSucceeded forgets the failed logins as username after the user passed all authentication steps
+// The failures of the IP address are kept, or logging in to an own account would allow guessing more passwords
+func (s *Server) loginSucceeded(username string) {
+	err := s.db.ClearLoginThrottle(models.ThrottleUsername, strings.ToLower(username))
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("couldn't clear failed logins of %s: %v", username, err)
+	}
+}
+
+// setRetryAfter sets the Retry-After header, in whole seconds rounded up
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := int((d + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+// lockedOutMessage tells users how long they have to wait before they can try to log in again
+func lockedOutMessage(d time.Duration) string {
+	return fmt.Sprintf("too many failed logins, try again in %v", ((d + time.Second - 1) / time.Second * time.Second))
+}
+
+// clearLoginThrottle lifts a lockout on behalf of an admin
+// Returns the HTTP status and the error which prevented it
+func (s *Server) clearLoginThrottle(kind, value string) (int, error) {
+	switch kind {
+	case models.ThrottleUsername:
+		// Usernames are counted in lower case, see loginThrottles
+		value = strings.ToLower(strings.TrimSpace(value))
+	case models.ThrottleIP:
+	default:
+		return http.StatusBadRequest, fmt.Errorf("invalid kind %q", kind)
+	}
+
+	if err := s.db.ClearLoginThrottle(kind, value); err != nil {
+		if err == sql.ErrNoRows {
+			return http.StatusNotFound, err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottlePolicyLockout(t *testing.T) {
+	p := ThrottlePolicy{FreeFailures: 5, BaseLockout: 30 * time.Second, MaxLockout: 15 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, 0},
+		{6, 30 * time.Second},
+		{7, time.Minute},
+		{8, 2 * time.Minute},
+		{10, 8 * time.Minute},
+		// 16 minutes is capped
+		{11, 15 * time.Minute},
+		{12, 15 * time.Minute},
+		// Doubling must not overflow with many failures
+		{1000, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := p.Lockout(tt.failures); got != tt.want {
+			t.Errorf("Lockout(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// TestLoginThrottle locks out a username, regardless of its case, and checks that a successful login lifts it again
+func TestLoginThrottle(t *testing.T) {
+	s := newTestServer(t)
+	const ip = "203.0.113.7"
+
+	for i := 0; i < UsernameThrottle.FreeFailures; i++ {
+		s.loginFailed("Alice", ip)
+	}
+	if wait, err := s.loginRetryAfter("alice", ip); err != nil || wait != 0 {
+		t.Fatalf("locked out for %v (%v) after %d failures", wait, err, UsernameThrottle.FreeFailures)
+	}
+
+	s.loginFailed("ALICE", ip)
+	wait, err := s.loginRetryAfter("alice", ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > UsernameThrottle.BaseLockout {
+		t.Fatalf("locked out for %v, want up to %v", wait, UsernameThrottle.BaseLockout)
+	}
+
+	// The address is below its limit, so another user can still log in from it
+	if wait, err := s.loginRetryAfter("bob", ip); err != nil || wait != 0 {
+		t.Errorf("bob is locked out for %v (%v)", wait, err)
+	}
+
+	s.loginSucceeded("Alice")
+	if wait, err := s.loginRetryAfter("alice", ip); err != nil || wait != 0 {
+		t.Errorf("still locked out for %v (%v) after logging in", wait, err)
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/golangbg/web-api-development-demo/pkg/database"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// profileUpdate contains the changes users make to their own account, a nil Name or Email is left unchanged
+// The password is only changed if NewPassword is set, and only if CurrentPassword is correct
+type profileUpdate struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	CurrentPassword string  `json:"current_password"`
+	NewPassword     string  `json:"new_password"`
+}
+
+// updateProfile applies the changes users make to their own account
+// A new email address has to be verified again, a verification link is sent to it
+// Returns the updated user, or the HTTP status and the error which prevented the update
+func (s *Server) updateProfile(user models.User, upd profileUpdate) (models.User, int, error) {
+	if upd.Name != nil {
+		user.Name = strings.TrimSpace(*upd.Name)
+	}
+	emailChanged := setEmail(&user, upd.Email)
+
+	// Whoever got hold of a session or token mustn't be able to take over the account
+	if upd.NewPassword != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(upd.CurrentPassword)); err != nil {
+			return user, http.StatusForbidden, fmt.Errorf("the current password is wrong")
+		}
+		if err := models.ValidatePassword(upd.NewPassword, user.Username); err != nil {
+			return user, http.StatusBadRequest, err
+		}
+	}
+
+	// Perform validation
+	if err := user.Validate(); err != nil {
+		return user, http.StatusBadRequest, err
+	}
+
+	user, err := s.db.UpdateUser(user, upd.NewPassword)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, err
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	if emailChanged {
+		s.sendVerificationEmailOrLog(user)
+	}
+
+	return user, http.StatusOK, nil
+}
+
+// setEmail changes the email address of a user if email isn't nil, a changed address isn't verified anymore
+// Returns whether the address changed
+func setEmail(user *models.User, email *string) bool {
+	if email == nil {
+		return false
+	}
+
+	e := strings.TrimSpace(*email)
+	if e == user.Email {
+		return false
+	}
+	user.Email, user.EmailVerified = e, false
+	return true
+}
+
+// userUpdate contains the changes an admin makes to a user, fields which are nil are left unchanged
+// EmailVerified lets admins verify an email address without the link, or require the link to be opened again.
+// TOTPEnabled can only be switched off, for users who lost their authenticator app and their recovery codes
+type userUpdate struct {
+	Name          *string `json:"name"`
+	Email         *string `json:"email"`
+	EmailVerified *bool   `json:"email_verified"`
+	Role          *string `json:"role"`
+	Disabled      *bool   `json:"disabled"`
+	PasswordReset *bool   `json:"password_reset"`
+	TOTPEnabled   *bool   `json:"totp_enabled"`
+}
+
+// updateUser applies the changes an admin makes to a user
+// Admins can't disable, demote or reset their own account, so there is always an admin left to undo mistakes
+// Returns the updated user, or the HTTP status and the error which prevented the update
+func (s *Server) updateUser(admin models.User, username string, upd userUpdate) (models.User, int, error) {
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, err
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	if upd.Name != nil {
+		user.Name = strings.TrimSpace(*upd.Name)
+	}
+	emailChanged := setEmail(&user, upd.Email)
+	if upd.EmailVerified != nil {
+		user.EmailVerified = *upd.EmailVerified
+	}
+	if upd.Role != nil {
+		user.Role = *upd.Role
+	}
+	if upd.Disabled != nil {
+		user.Disabled = *upd.Disabled
+	}
+	if upd.PasswordReset != nil {
+		user.PasswordReset = *upd.PasswordReset
+	}
+
+	// Perform validation
+	if err := user.Validate(); err != nil {
+		return user, http.StatusBadRequest, err
+	}
+	if user.ID == admin.ID && (!user.Active() || !user.Can(models.PermManageUsers)) {
+		return user, http.StatusBadRequest, fmt.Errorf("you can't disable, demote or reset your own account")
+	}
+	removeTOTP := false
+	if upd.TOTPEnabled != nil && *upd.TOTPEnabled != user.TOTPEnabled {
+		if *upd.TOTPEnabled {
+			return user, http.StatusBadRequest, fmt.Errorf("only users can enable two-factor authentication themselves")
+		}
+		removeTOTP = true
+	}
+
+	user, err = s.db.UpdateUser(user, "")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, err
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	if removeTOTP {
+		if err := s.removeTOTP(user); err != nil {
+			return user, http.StatusInternalServerError, err
+		}
+		user.TOTPSecret, user.TOTPEnabled = "", false
+	}
+
+	if emailChanged {
+		s.sendVerificationEmailOrLog(user)
+	}
+
+	return user, http.StatusOK, nil
+}
+
+// deleteUser deletes a user on behalf of an admin, users who still have posts can only be disabled
+// Returns the deleted user, or the HTTP status and the error which prevented deleting it
+func (s *Server) deleteUser(admin models.User, username string) (models.User, int, error) {
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, err
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	if user.ID == admin.ID {
+		return user, http.StatusBadRequest, fmt.Errorf("you can't delete your own account")
+	}
+
+	if err := s.db.DeleteUser(user.Username); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return user, http.StatusNotFound, err
+		case database.ErrUserHasPosts:
+			return user, http.StatusConflict, fmt.Errorf("%s still has posts, disable the account instead", user.Username)
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	return user, http.StatusOK, nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golangbg/web-api-development-demo/pkg/mailer"
+	"github.com/golangbg/web-api-development-demo/pkg/models"
+)
+
+// EmailVerificationTTL is how long an email verification link can be used
+var EmailVerificationTTL = 48 * time.Hour
+
+// errPublishUnverified is returned when users who can't publish yet try to publish a post
+var errPublishUnverified = errors.New("verify your email address before publishing, until then posts can only be saved as drafts")
+
+// errInvalidVerification is returned for verification links which can't be used
+var errInvalidVerification = errors.New("the verification link is invalid or has expired, ask for a new one on your profile")
+
+// checkPublish checks whether the user may change the publication state of a post from previous to status
+// Publishing or scheduling requires a verified email address, posts which keep their state can always be saved.
+// previous is empty for new posts, which are published when they don't have a status
+func checkPublish(user models.User, status, previous string) error {
+	if status == models.StatusDraft || (previous != "" && status == previous) || user.CanPublish() {
+		return nil
+	}
+	return errPublishUnverified
+}
+
+// sendVerificationEmail sends a link to verify the email address of a user
+// The link is a signed token containing the username and the email address, so it stops working when the address
+// changes and nothing has to be stored
+func (s *Server) sendVerificationEmail(user models.User) error {
+	if user.Email == "" {
+		return fmt.Errorf("%s has no email address", user.Username)
+	}
+	if user.EmailVerified {
+		return fmt.Errorf("the email address of %s is verified already", user.Username)
+	}
+
+	// The token has no activeUser claim, so it can't be used to authenticate
+	token, err := s.CreateToken(map[string]interface{}{
+		"verifyUser":  user.Username,
+		"verifyEmail": user.Email,
+	}, time.Now().Add(EmailVerificationTTL).Unix())
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Go Blog! email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease verify the email address of your account %s within %v by opening:\n\n%s\n\n"+
+			"You can publish posts once your address is verified.\n",
+			displayName(user), user.Username, EmailVerificationTTL, strings.TrimSuffix(s.BaseURL, "/")+"/verify/"+token),
+	})
+}
+
+// sendVerificationEmailOrLog sends a verification email after the email address of a user was set
+// The address is saved already, so a failure is only logged, the user can ask for a new link on the profile
+func (s *Server) sendVerificationEmailOrLog(user models.User) {
+	if user.Email == "" || user.EmailVerified {
+		return
+	}
+	if err := s.sendVerificationEmail(user); err != nil {
+		log.Printf("couldn't send verification email to %s: %v", user.Username, err)
+	}
+}
+
+// resendVerification sends a new verification link to a user
+// Returns the HTTP status and the error which prevented sending it
+func (s *Server) resendVerification(username string) (models.User, int, error) {
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, err
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	if user.Email == "" || user.EmailVerified {
+		return user, http.StatusBadRequest, fmt.Errorf("%s has no email address which needs verification", user.Username)
+	}
+	if err := s.sendVerificationEmail(user); err != nil {
+		return user, http.StatusInternalServerError, err
+	}
+
+	return user, http.StatusAccepted, nil
+}
+
+// verifyEmail verifies the email address of a user with the token of a verification link
+// Opening a link twice does no harm, the address is simply verified already
+// Returns the verified user, or the HTTP status and the error which prevented the verification
+func (s *Server) verifyEmail(token string) (models.User, int, error) {
+	claims, err := s.ParseToken(token)
+	if err != nil {
+		return models.User{}, http.StatusNotFound, errInvalidVerification
+	}
+	username, _ := claims["verifyUser"].(string)
+	email, _ := claims["verifyEmail"].(string)
+	if username == "" || email == "" {
+		return models.User{}, http.StatusNotFound, errInvalidVerification
+	}
+
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, http.StatusNotFound, errInvalidVerification
+		}
+		return user, http.StatusInternalServerError, err
+	}
+
+	// Links sent to an earlier address of the user don't verify the current one
+	if user.Email != email {
+		return user, http.StatusNotFound, errInvalidVerification
+	}
+	if user.EmailVerified {
+		return user, http.StatusOK, nil
+	}
+
+	user.EmailVerified = true
+	if user, err = s.db.UpdateUser(user, ""); err != nil {
+		return user, http.StatusInternalServerError, err
+	}
+
+	return user, http.StatusOK, nil
+}
@@ -6,15 +6,21 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/golangbg/web-api-development-demo/pkg/database"
 	"github.com/golangbg/web-api-development-demo/pkg/models"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
 )
 
-// rootHandler gets and displays all posts
+// rootHandler gets and displays a page of posts, the page is selected with the page query parameter
 func (s *Server) rootHandler(files ...string) http.HandlerFunc {
 	// This part is executed only once when we invoke rootHandler in routes.go (so when the server instance is created)
 	log.Println("rootHandler initialization")
@@ -30,13 +36,17 @@ func (s *Server) rootHandler(files ...string) http.HandlerFunc {
 		data := make(map[string]interface{})
 
 		// Prepare the data which will be sent to the template
-		var err error
-		data["Posts"], err = s.db.GetAllPosts()
+		data["Heading"] = "Welcome to my blog!"
+		found, err := s.preparePostList(r, database.PostFilter{}, "/", data)
 		if err != nil {
 			log.Printf("database error: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
 
 		// Prepare data
 		s.PrepareData(w, r, data)
@@ -51,13 +61,8 @@ func (s *Server) rootHandler(files ...string) http.HandlerFunc {
 	}
 }
 
-// postReadHandler gets and displays a single post
-func (s *Server) postReadHandler(files ...string) http.HandlerFunc {
-	log.Println("postReadHandler initialization")
-
-	// sync.Once allows to defer expensive transactions until the first time the handlerFunc is called
-	// also this will allow to reply with a decent error instead of panicing
-	// https://golang.org/pkg/sync/#Once.Do
+// archiveHandler gets and displays a page of posts created in a single year or month
+func (s *Server) archiveHandler(files ...string) http.HandlerFunc {
 	var (
 		init sync.Once
 		tpl  *template.Template
@@ -65,11 +70,8 @@ func (s *Server) postReadHandler(files ...string) http.HandlerFunc {
 	)
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("postReadHandler HandlerFunc")
-
 		// Execute initialization transactions only once
 		init.Do(func() {
-			log.Println("postReadHandler init.Do")
 			tpl, err = template.New("").ParseFiles(files...)
 		})
 		if err != nil {
@@ -78,19 +80,37 @@ func (s *Server) postReadHandler(files ...string) http.HandlerFunc {
 		}
 		args := mux.Vars(r)
 
-		post, err := s.db.GetPostBySlug(args["slug"])
-		if err != nil && err == sql.ErrNoRows {
-			http.NotFound(w, r)
-			return
-		} else if err != nil {
-			log.Printf("database error: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		// The routes make sure year and month are numbers
+		year, _ := strconv.Atoi(args["year"])
+		from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		to := from.AddDate(1, 0, 0)
+		heading := fmt.Sprintf("Archive: %d", year)
+
+		// The month is optional
+		if m, ok := args["month"]; ok {
+			month, _ := strconv.Atoi(m)
+			if month < 1 || month > 12 {
+				http.NotFound(w, r)
+				return
+			}
+			from = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+			to = from.AddDate(0, 1, 0)
+			heading = fmt.Sprintf("Archive: %s %d", from.Month(), year)
 		}
 
 		// Prepare the data which will be sent to the template
 		data := map[string]interface{}{
-			"Post": post,
+			"Heading": heading,
+		}
+		found, err := s.preparePostList(r, database.PostFilter{From: from, To: to}, r.URL.Path, data)
+		if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
 		}
 
 		// Prepare data
@@ -106,8 +126,8 @@ func (s *Server) postReadHandler(files ...string) http.HandlerFunc {
 	}
 }
 
-// postCreateHandler renders and displays a form for creating a new post
-func (s *Server) postCreateHandler(files ...string) http.HandlerFunc {
+// tagHandler gets and displays a page of posts with a single tag
+func (s *Server) tagHandler(files ...string) http.HandlerFunc {
 	var (
 		init sync.Once
 		tpl  *template.Template
@@ -123,24 +143,35 @@ func (s *Server) postCreateHandler(files ...string) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		args := mux.Vars(r)
 
-		data := make(map[string]interface{})
+		// Redirect to the normalized tag, so every tag has a single URL
+		tag := models.NormalizeTag(args["name"])
+		if tag == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if tag != args["name"] {
+			http.Redirect(w, r, "/tag/"+url.PathEscape(tag), http.StatusMovedPermanently)
+			return
+		}
 
-		// Get the session
-		session, err := s.store.Get(r, SessionName)
+		// Prepare the data which will be sent to the template
+		data := map[string]interface{}{
+			"Heading": fmt.Sprintf("Posts tagged %q", tag),
+		}
+		found, err := s.preparePostList(r, database.PostFilter{Tag: tag}, r.URL.Path, data)
 		if err != nil {
+			log.Printf("database error: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// Check if the session has a currentPost, if so pass it via data
-		if currentPost, ok := session.Values["currentPost"]; ok {
-			data["CurrentPost"] = currentPost
-			delete(session.Values, "currentPost")
-			session.Save(r, w)
+		if !found {
+			http.NotFound(w, r)
+			return
 		}
 
-		// Prepare the data
+		// Prepare data
 		s.PrepareData(w, r, data)
 
 		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
@@ -153,71 +184,118 @@ func (s *Server) postCreateHandler(files ...string) http.HandlerFunc {
 	}
 }
 
-func (s *Server) postSaveHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse the HTML form
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// searchHandler searches the posts and displays the results, the query is passed through the q query parameter
+func (s *Server) searchHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
 
-	// Get the slug from the parsed HTML form
-	slug := r.FormValue("slug")
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	// Get the session
-	session, err := s.store.Get(r, SessionName)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		data := map[string]interface{}{
+			"Query": q,
+		}
+
+		// Only search if there is something to search for, otherwise just show the form
+		if q != "" {
+			results, err := s.db.SearchPosts(q, postsPerPage, 0)
+			if err == database.ErrSearchUnavailable {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
+			}
+			if err != nil {
+				log.Printf("database error: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data["Results"] = results
+		}
+
+		// Prepare data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
+}
 
-	// Create a post
-	post := models.Post{
-		Slug:  slug,
-		Title: r.FormValue("title"),
-		Body:  template.HTML(r.FormValue("body")),
-		// Link the new post the the logged in user by getting the userID from the session
-		// session.Values uses an interface to store data, therefore we need to assert to int64
-		// https://tour.golang.org/methods/15
-		UserID: session.Values["activeUserID"].(int64),
+// postsPerPage is the number of posts on a single page of the web frontend
+const postsPerPage = 10
+
+// preparePostList adds a page of posts, the pagination and the archive sidebar to the template data
+// basePath is the URL the pagination links point to. Returns false if the requested page doesn't exist
+func (s *Server) preparePostList(r *http.Request, filter database.PostFilter, basePath string, data map[string]interface{}) (bool, error) {
+	// Authors also see their own unpublished posts
+	filter.Viewer = s.activeUser(r).Viewer()
+
+	// Get the page number, the first page is the default
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		var err error
+		if page, err = strconv.Atoi(p); err != nil || page < 1 {
+			return false, nil
+		}
 	}
 
-	// Get the session
-	session, err = s.store.Get(r, SessionName)
+	count, err := s.db.CountPosts(filter)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return false, err
 	}
 
-	// Validate the post
-	if err := post.Validate(); err != nil {
-		// Validation went wrong, we will use the session to pass the validation error in an elegant way
+	// Only the first page may be empty
+	if page > 1 && (page-1)*postsPerPage >= count {
+		return false, nil
+	}
 
-		// Add a flash message and the post to the session. Then save the session.
-		session.AddFlash(err.Error())
-		session.Values["currentPost"] = post
-		session.Save(r, w)
+	posts, err := s.db.GetPostsByPage(filter, page, postsPerPage)
+	if err != nil {
+		return false, err
+	}
 
-		// Redirect
-		http.Redirect(w, r, "/new", http.StatusFound)
-		return
+	archive, err := s.db.GetArchive()
+	if err != nil {
+		return false, err
 	}
 
-	// Create / overwrite the post
-	if _, err := s.db.SavePost(post); err != nil {
-		// Add a flash message and the post to the session. Then save the session.
-		session.AddFlash(fmt.Sprintf("database error: %v", err.Error()))
-		session.Values["currentPost"] = post
-		session.Save(r, w)
+	data["Posts"] = posts
+	data["Archive"] = archive
+	data["BasePath"] = basePath
+	data["Page"] = page
 
-		// Redirect
-		http.Redirect(w, r, "/new", http.StatusFound)
-		return
+	// A zero value means there is no previous or next page
+	if page > 1 {
+		data["PrevPage"] = page - 1
 	}
-	http.Redirect(w, r, "/"+post.Slug, http.StatusFound)
+	if page*postsPerPage < count {
+		data["NextPage"] = page + 1
+	}
+
+	return true, nil
 }
 
-// userCreateHandler renders and displays a form for creating a new user
-func (s *Server) userCreateHandler(files ...string) http.HandlerFunc {
+// postReadHandler gets and displays a single post
+func (s *Server) postReadHandler(files ...string) http.HandlerFunc {
+	log.Println("postReadHandler initialization")
+
+	// sync.Once allows to defer expensive transactions until the first time the handlerFunc is called
+	// also this will allow to reply with a decent error instead of panicing
+	// https://golang.org/pkg/sync/#Once.Do
 	var (
 		init sync.Once
 		tpl  *template.Template
@@ -225,32 +303,84 @@ func (s *Server) userCreateHandler(files ...string) http.HandlerFunc {
 	)
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("postReadHandler HandlerFunc")
+
 		// Execute initialization transactions only once
 		init.Do(func() {
+			log.Println("postReadHandler init.Do")
 			tpl, err = template.New("").ParseFiles(files...)
 		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		args := mux.Vars(r)
+		user := s.activeUser(r)
+		viewer := user.Viewer()
 
-		data := make(map[string]interface{})
+		post, err := s.db.GetPostBySlug(args["slug"], viewer)
+		if err != nil && err == sql.ErrNoRows {
+			// The post may have been renamed, then its old URL redirects permanently
+			if slug, ok := s.movedPostSlug(args["slug"], viewer); ok {
+				http.Redirect(w, r, "/"+slug, http.StatusMovedPermanently)
+				return
+			}
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		// Get the session
-		session, err := s.store.Get(r, SessionName)
+		// Get the comments, threaded with their replies
+		comments, err := s.getCommentThreads(post.Slug)
 		if err != nil {
+			log.Printf("database error: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Check if the session has a currentPost, if so pass it via data
-		if currentUser, ok := session.Values["currentUser"]; ok {
-			data["CurrentUser"] = currentUser
-			delete(session.Values, "currentUser")
+		// Prepare the data which will be sent to the template
+		data := map[string]interface{}{
+			"Post":      post,
+			"Comments":  comments,
+			"CanEdit":   user.CanEditPost(post),
+			"CanDelete": user.CanDeletePost(post),
+		}
+
+		// The reply links pass the comment to reply to in the query
+		if replyTo, err := strconv.ParseInt(r.URL.Query().Get("reply"), 10, 64); err == nil {
+			data["ReplyTo"] = replyTo
+		}
+
+		// After commenting, the visitor is told when the comment waits for moderation
+		data["CommentPending"] = r.URL.Query().Get("comment") == "pending"
+
+		// The author and editors are reminded of the comments waiting for moderation
+		if user.CanEditPost(post) {
+			pending, err := s.db.GetComments(post.Slug, models.CommentPending)
+			if err != nil {
+				log.Printf("database error: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data["PendingComments"] = len(pending)
+		}
+
+		// Check if the session has a currentComment, if so pass it via data
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if currentComment, ok := session.Values["currentComment"]; ok {
+			data["CurrentComment"] = currentComment
+			delete(session.Values, "currentComment")
 			session.Save(r, w)
 		}
 
-		// Prepare the data
+		// Prepare data
 		s.PrepareData(w, r, data)
 
 		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
@@ -263,7 +393,8 @@ func (s *Server) userCreateHandler(files ...string) http.HandlerFunc {
 	}
 }
 
-func (s *Server) userSaveHandler(w http.ResponseWriter, r *http.Request) {
+// commentSaveHandler adds a comment to a post, on behalf of the logged in user or anonymously
+func (s *Server) commentSaveHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the HTML form
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -277,56 +408,54 @@ func (s *Server) userSaveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a user
-	user := models.User{
-		Username: r.FormValue("username"),
-		Name:     r.FormValue("name"),
+	args := mux.Vars(r)
+	comment := models.Comment{
+		Slug:  args["slug"],
+		Name:  r.FormValue("name"),
+		Email: r.FormValue("email"),
+		Body:  r.FormValue("body"),
 	}
 
-	// Validate the user
-	if err := user.Validate(); err != nil {
-		// Validation went wrong, we will use the session to pass the validation error in an elegant way
-		// Add a flash message and the post to the session. Then save the session.
-		session.AddFlash(err.Error())
-		session.Values["currentUser"] = user
-		session.Save(r, w)
+	// The parent is empty for top level comments
+	back := "/" + comment.Slug + "#comment-form"
+	if parent := r.FormValue("parent_id"); parent != "" {
+		comment.ParentID, err = strconv.ParseInt(parent, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid parent comment", http.StatusBadRequest)
+			return
+		}
+		back = fmt.Sprintf("/%s?reply=%d#comment-form", comment.Slug, comment.ParentID)
+	}
 
-		// Redirect
-		http.Redirect(w, r, "/register", http.StatusFound)
+	// The website field is a honeypot, it's hidden in the form
+	sub := models.CommentSubmission{Comment: comment, IP: s.remoteIP(r), Honeypot: r.FormValue("website")}
+	comment, status, err := s.addComment(sub, s.activeUser(r))
+	if status == http.StatusNotFound {
+		http.NotFound(w, r)
 		return
 	}
-
-	// Check if password and confirmPassword match
-	password := r.FormValue("password")
-	confirmPassword := r.FormValue("confirmPassword")
-
-	if password != confirmPassword {
-		// Add a flash message and the post to the session. Then save the session.
-		session.AddFlash("passwords don't match")
-		session.Values["currentUser"] = user
+	if err != nil {
+		// Add a flash message and the comment to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentComment"] = comment
 		session.Save(r, w)
 
 		// Redirect
-		http.Redirect(w, r, "/register", http.StatusFound)
+		http.Redirect(w, r, back, http.StatusFound)
 		return
 	}
 
-	// Create / overwrite the user
-	if _, err := s.db.SaveUser(user, password); err != nil {
-		// Add a flash message and the post to the session. Then save the session.
-		session.AddFlash(fmt.Sprintf("database error: %v", err.Error()))
-		session.Values["currentUser"] = user
-		session.Save(r, w)
-
-		// Redirect
-		http.Redirect(w, r, "/register", http.StatusFound)
+	// Spam isn't told apart from other comments waiting for moderation, that would help spammers
+	if comment.Status != models.CommentApproved {
+		http.Redirect(w, r, "/"+comment.Slug+"?comment=pending#comment-form", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/", http.StatusFound)
+
+	http.Redirect(w, r, fmt.Sprintf("/%s#comment-%d", comment.Slug, comment.ID), http.StatusFound)
 }
 
-// userLoginHandler renders and displays a form for logging in
-func (s *Server) userLoginHandler(files ...string) http.HandlerFunc {
+// commentModerationHandler renders and displays the comments on a post with a moderation state, pending by default
+func (s *Server) commentModerationHandler(files ...string) http.HandlerFunc {
 	var (
 		init sync.Once
 		tpl  *template.Template
@@ -342,9 +471,50 @@ func (s *Server) userLoginHandler(files ...string) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		args := mux.Vars(r)
 
-		data := make(map[string]interface{})
-		// Prepare data
+		user := s.activeUser(r)
+		post, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+		if err != nil && err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Only the author of the post and editors are allowed to moderate its comments
+		if !user.CanEditPost(post) {
+			http.Error(w, "only the author or an editor can moderate the comments on this post", http.StatusForbidden)
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = models.CommentPending
+		}
+		if !models.ValidCommentStatus(status) {
+			http.Error(w, "invalid status", http.StatusBadRequest)
+			return
+		}
+
+		comments, err := s.db.GetComments(post.Slug, status)
+		if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare the data which will be sent to the template
+		data := map[string]interface{}{
+			"Post":     post,
+			"Status":   status,
+			"Statuses": []string{models.CommentPending, models.CommentApproved, models.CommentRejected, models.CommentSpam},
+			"Comments": comments,
+		}
+
+		// Prepare the data
 		s.PrepareData(w, r, data)
 
 		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
@@ -357,8 +527,11 @@ func (s *Server) userLoginHandler(files ...string) http.HandlerFunc {
 	}
 }
 
-// userAuthenticateHandler handles user authentication
-func (s *Server) userAuthenticateHandler(w http.ResponseWriter, r *http.Request) {
+// commentModerateHandler approves or rejects a comment, or marks it as spam
+// Afterwards the moderation page is shown again, with the comments in the state which was shown before
+func (s *Server) commentModerateHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
 	// Parse the HTML form
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -372,44 +545,1743 @@ func (s *Server) userAuthenticateHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Get the username and password from the form
-	// Here we do that manually, Gorilla offers schemas to make this job easier
-	// http://www.gorillatoolkit.org/pkg/schema
-	username := r.FormValue("username")
-	password := r.FormValue("password")
+	user := s.activeUser(r)
+	post, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+	if err != nil && err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("database error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the author of the post and editors are allowed to moderate its comments
+	if !user.CanEditPost(post) {
+		http.Error(w, "only the author or an editor can moderate the comments on this post", http.StatusForbidden)
+		return
+	}
+
+	// The route only matches digits, so only an out of range ID fails here
+	id, err := strconv.ParseInt(args["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid comment", http.StatusBadRequest)
+		return
+	}
+
+	// The route only matches known actions
+	if _, err := s.db.SetCommentStatus(post.Slug, id, models.CommentActions[args["action"]]); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("database error: %v", err.Error()))
+		session.Save(r, w)
+	}
+
+	back := "/" + post.Slug + "/moderate"
+	if status := r.FormValue("status"); models.ValidCommentStatus(status) {
+		back += "?status=" + status
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// postCreateHandler renders and displays a form for creating a new post
+func (s *Server) postCreateHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Users who can't publish yet are told how to change that
+		data := map[string]interface{}{
+			"CanPublish": s.activeUser(r).CanPublish(),
+		}
+
+		// Get the session
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Check if the session has a currentPost, if so pass it via data
+		if currentPost, ok := session.Values["currentPost"]; ok {
+			data["CurrentPost"] = currentPost
+			delete(session.Values, "currentPost")
+			session.Save(r, w)
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// parsePublication reads the publication state from a post form
+// The publication date is only read for scheduled posts, it's entered in the time zone of the server
+func parsePublication(r *http.Request) (status string, publishAt time.Time, err error) {
+	status = r.FormValue("status")
+	if status != models.StatusScheduled || r.FormValue("publish_at") == "" {
+		return status, publishAt, nil
+	}
+
+	publishAt, err = time.ParseInLocation(models.PublishAtFormat, r.FormValue("publish_at"), time.Local)
+	if err != nil {
+		return status, publishAt, fmt.Errorf("invalid publication date")
+	}
+
+	return status, publishAt, nil
+}
+
+func (s *Server) postSaveHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Create a post
+	post := models.Post{
+		Title: r.FormValue("title"),
+		// The body is rendered from the Markdown below
+		Markdown: r.FormValue("markdown"),
+		Tags:     models.ParseTags(r.FormValue("tags")),
+		// Unchecked checkboxes aren't sent with the form
+		AutoApproveComments: r.FormValue("auto_approve_comments") != "",
+		// Link the new post the the logged in user by getting the userID from the session
+		// session.Values uses an interface to store data, therefore we need to assert to int64
+		// https://tour.golang.org/methods/15
+		UserID: session.Values["activeUserID"].(int64),
+	}
+
+	// Get the session
+	session, err = s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Use the requested slug, or generate one from the title
+	post.Slug, err = s.newPostSlug(r.FormValue("slug"), post.Title)
+	if err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/new", http.StatusFound)
+		return
+	}
+
+	// Set the publication state, publishing requires a verified email address
+	post.Status, post.PublishAt, err = parsePublication(r)
+	if err == nil {
+		err = checkPublish(s.activeUser(r), post.Status, "")
+	}
+	if err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/new", http.StatusFound)
+		return
+	}
+
+	// Render the Markdown into the body
+	if err := post.Render(); err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("markdown error: %v", err.Error()))
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/new", http.StatusFound)
+		return
+	}
+
+	// Validate the post
+	if err := post.Validate(); err != nil {
+		// Validation went wrong, we will use the session to pass the validation error in an elegant way
+
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/new", http.StatusFound)
+		return
+	}
+
+	// Create the post, an existing post with the same slug is never overwritten
+	if _, err := s.db.CreatePost(post); err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("database error: %v", err.Error()))
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/new", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/"+post.Slug, http.StatusFound)
+}
+
+// postEditHandler renders and displays a form for editing an existing post
+func (s *Server) postEditHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args := mux.Vars(r)
+
+		// Get the session
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user := s.activeUser(r)
+		post, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+		if err != nil && err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Only the author of the post and editors are allowed to edit it
+		if !user.CanEditPost(post) {
+			http.Error(w, "only the author or an editor can edit this post", http.StatusForbidden)
+			return
+		}
+
+		data := map[string]interface{}{
+			"CurrentPost": post,
+			"Editing":     true,
+			"CanPublish":  user.CanPublish(),
+		}
+
+		// Check if the session has a currentPost, if so it contains the rejected changes
+		if currentPost, ok := session.Values["currentPost"]; ok {
+			data["CurrentPost"] = currentPost
+			delete(session.Values, "currentPost")
+			session.Save(r, w)
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// postUpdateHandler saves the changes to an existing post
+func (s *Server) postUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := s.activeUser(r)
+	existing, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+	if err != nil && err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("database error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the author of the post and editors are allowed to edit it
+	if !user.CanEditPost(existing) {
+		http.Error(w, "only the author or an editor can edit this post", http.StatusForbidden)
+		return
+	}
+
+	// Update the post, the author and creation date can't be changed
+	post := existing
+	post.EditorID = user.ID
+	post.Title = r.FormValue("title")
+	post.Markdown = r.FormValue("markdown")
+	post.Tags = models.ParseTags(r.FormValue("tags"))
+	post.AutoApproveComments = r.FormValue("auto_approve_comments") != ""
+
+	// A new slug renames the post, the old URL will redirect to the new one
+	post.Slug, err = editedPostSlug(existing.Slug, r.FormValue("slug"))
+	if err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/"+existing.Slug+"/edit", http.StatusFound)
+		return
+	}
+
+	// Update the publication state, a published post keeps its publication date
+	// Publishing requires a verified email address
+	status, publishAt, err := parsePublication(r)
+	if err == nil {
+		err = checkPublish(user, status, existing.Status)
+	}
+	if err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/"+existing.Slug+"/edit", http.StatusFound)
+		return
+	}
+	post.Status = status
+	if status == models.StatusScheduled {
+		post.PublishAt = publishAt
+	}
+
+	// Render the Markdown into the body
+	if err := post.Render(); err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("markdown error: %v", err.Error()))
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/"+existing.Slug+"/edit", http.StatusFound)
+		return
+	}
+
+	// Validate the post
+	if err := post.Validate(); err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/"+existing.Slug+"/edit", http.StatusFound)
+		return
+	}
+
+	// Update the post, a new slug renames it at the same time. The post is left untouched if anything fails
+	if _, err := s.db.UpdatePost(existing.Slug, post); err != nil {
+		msg := fmt.Sprintf("database error: %v", err.Error())
+		if err == database.ErrPostExists {
+			msg = "the slug is already used by another post"
+		}
+
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(msg)
+		session.Values["currentPost"] = post
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/"+existing.Slug+"/edit", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/"+post.Slug, http.StatusFound)
+}
+
+// postDeleteConfirmHandler renders and displays a confirmation form for deleting a post
+func (s *Server) postDeleteConfirmHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args := mux.Vars(r)
+
+		user := s.activeUser(r)
+		post, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+		if err != nil && err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Only the author of the post and admins are allowed to delete it
+		if !user.CanDeletePost(post) {
+			http.Error(w, "only the author or an admin can delete this post", http.StatusForbidden)
+			return
+		}
+
+		// Prepare the data which will be sent to the template
+		data := map[string]interface{}{
+			"Post": post,
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// postDeleteHandler deletes a post after the deletion has been confirmed
+func (s *Server) postDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	user := s.activeUser(r)
+	post, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+	if err != nil && err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("database error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the author of the post and admins are allowed to delete it
+	if !user.CanDeletePost(post) {
+		http.Error(w, "only the author or an admin can delete this post", http.StatusForbidden)
+		return
+	}
+
+	// Delete the post
+	if err := s.db.DeletePost(post.Slug); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("database error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// postHistoryHandler renders and displays the revisions of a post
+// When the from and to query parameters are provided, the differences between those revisions are displayed as well
+func (s *Server) postHistoryHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args := mux.Vars(r)
+		params := r.URL.Query()
+
+		user := s.activeUser(r)
+		post, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+		if err != nil && err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Only the author of the post and editors are allowed to see its history
+		if !user.CanEditPost(post) {
+			http.Error(w, "only the author or an editor can see the history of this post", http.StatusForbidden)
+			return
+		}
+
+		revisions, err := s.db.GetRevisions(post.Slug)
+		if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare the data which will be sent to the template
+		data := map[string]interface{}{
+			"Post":      post,
+			"Revisions": revisions,
+		}
+
+		// Compare two revisions if requested
+		if params.Get("from") != "" || params.Get("to") != "" {
+			fromID, err := parseRevisionID(params.Get("from"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			toID, err := parseRevisionID(params.Get("to"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			from, to, err := selectRevisions(revisions, fromID, toID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			diff, err := models.DiffRevisions(from, to)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			data["From"] = from
+			data["To"] = to
+			data["Diff"] = diff
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// postRestoreHandler restores a post to the content of one of its revisions
+func (s *Server) postRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := s.activeUser(r)
+	existing, err := s.db.GetPostBySlug(args["slug"], user.Viewer())
+	if err != nil && err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("database error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the author of the post and editors are allowed to restore it
+	if !user.CanEditPost(existing) {
+		http.Error(w, "only the author or an editor can restore this post", http.StatusForbidden)
+		return
+	}
+
+	// The route only matches digits, so only an out of range ID fails here
+	id, err := strconv.ParseInt(args["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	rev, err := s.db.GetRevision(existing.Slug, id)
+	if err != nil && err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("database error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Render the restored Markdown, the sanitization policy may have changed since the revision was saved
+	post := rev.Restore(existing)
+	post.EditorID = user.ID
+	if err := post.Render(); err == nil {
+		err = post.Validate()
+	}
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("couldn't restore revision %d: %v", rev.ID, err))
+		session.Save(r, w)
+		http.Redirect(w, r, "/"+existing.Slug+"/history", http.StatusFound)
+		return
+	}
+
+	if _, err := s.db.UpdatePost(post.Slug, post); err != nil {
+		session.AddFlash(fmt.Sprintf("database error: %v", err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/"+existing.Slug+"/history", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/"+post.Slug, http.StatusFound)
+}
+
+// userCreateHandler renders and displays a form for creating a new user
+func (s *Server) userCreateHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The form explains the rules for usernames and passwords
+		data := map[string]interface{}{
+			"MinUsernameLength": models.MinUsernameLength,
+			"MaxUsernameLength": models.MaxUsernameLength,
+			"MinPasswordLength": models.MinPasswordLength,
+		}
+
+		// Get the session
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Check if the session has a currentPost, if so pass it via data
+		if currentUser, ok := session.Values["currentUser"]; ok {
+			data["CurrentUser"] = currentUser
+			delete(session.Values, "currentUser")
+			session.Save(r, w)
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (s *Server) userSaveHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Create a user
+	user := models.User{
+		Username: strings.TrimSpace(r.FormValue("username")),
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Email:    strings.TrimSpace(r.FormValue("email")),
+	}
+
+	// Validate the user
+	if err := user.Validate(); err != nil {
+		// Validation went wrong, we will use the session to pass the validation error in an elegant way
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentUser"] = user
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/register", http.StatusFound)
+		return
+	}
+
+	// Check if password and confirmPassword match
+	password := r.FormValue("password")
+	confirmPassword := r.FormValue("confirmPassword")
+
+	if password != confirmPassword {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash("passwords don't match")
+		session.Values["currentUser"] = user
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/register", http.StatusFound)
+		return
+	}
+
+	// Check the password against the password policy
+	if err := models.ValidatePassword(password, user.Username); err != nil {
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Values["currentUser"] = user
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/register", http.StatusFound)
+		return
+	}
+
+	// Create the user, an existing user is never overwritten
+	created, err := s.db.CreateUser(user, password)
+	if err != nil {
+		msg := fmt.Sprintf("database error: %v", err.Error())
+		if err == database.ErrUserExists {
+			msg = fmt.Sprintf("username taken, %s is already used by someone else", user.Username)
+		}
+
+		// Add a flash message and the post to the session. Then save the session.
+		session.AddFlash(msg)
+		session.Values["currentUser"] = user
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/register", http.StatusFound)
+		return
+	}
+
+	// The new user can login right away, publishing has to wait until the email address is verified
+	s.sendVerificationEmailOrLog(created)
+	http.Redirect(w, r, "/login?registered=1", http.StatusFound)
+}
+
+// userLoginHandler renders and displays a form for logging in
+func (s *Server) userLoginHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// After choosing a new password with a reset link, the user is sent here to login
+		data := map[string]interface{}{
+			"PasswordChanged": r.URL.Query().Get("reset") == "done",
+			"Registered":      r.URL.Query().Get("registered") != "",
+			"EmailVerified":   r.URL.Query().Get("verified") != "",
+		}
+		// Prepare data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// userAuthenticateHandler handles user authentication
+func (s *Server) userAuthenticateHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the username and password from the form
+	// Here we do that manually, Gorilla offers schemas to make this job easier
+	// http://www.gorillatoolkit.org/pkg/schema
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	// Refuse logins while the username or the address is locked out after too many failed logins
+	if s.loginLockedOut(w, r, session, username) {
+		return
+	}
+
+	// Get the user from the database
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil {
+		// Couldn't get the user from the database, unknown usernames count as failed logins too
+		log.Printf("db error: %v", err)
+		if err == sql.ErrNoRows {
+			s.loginFailed(username, s.remoteIP(r))
+		}
+		session.AddFlash("login failed")
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// Check if the password matches
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		// Password doesn't match
+		s.loginFailed(username, s.remoteIP(r))
+		session.AddFlash("login failed")
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// Disabled users can't log in
+	if user.Disabled {
+		session.AddFlash(inactiveReason(user))
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// Users with two-factor authentication enter their second factor next, the session remembers the password was
+	// correct for a short while
+	if user.TOTPEnabled {
+		session.Values["mfaUser"] = user.Username
+		session.Values["mfaExpires"] = time.Now().Add(MFAChallengeTTL).Unix()
+		session.Save(r, w)
+		http.Redirect(w, r, "/login/mfa", http.StatusFound)
+		return
+	}
+
+	s.completeLogin(w, r, session, user)
+}
+
+// completeLogin logs in a user who passed all authentication steps
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, user models.User) {
+	// The user knew the password and the second factor, so the failed logins before were probably typos
+	s.loginSucceeded(user.Username)
+
+	// Users whose password was reset by an admin have to choose a new password before they are logged in
+	if user.PasswordReset {
+		session.Values["passwordResetUser"] = user.Username
+		session.Save(r, w)
+		http.Redirect(w, r, "/login/password", http.StatusFound)
+		return
+	}
+
+	setActiveUser(session, user)
+	session.Save(r, w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// loginLockedOut sends the user back to the login form when logins as username from the address of the request are
+// locked out, and tells when to try again. Returns true when the login has to stop
+func (s *Server) loginLockedOut(w http.ResponseWriter, r *http.Request, session *sessions.Session, username string) bool {
+	wait, err := s.loginRetryAfter(username, s.remoteIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		session.AddFlash(lockedOutMessage(wait))
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return true
+	}
+	return false
+}
+
+// mfaSessionUser returns the username of the user who entered the correct password and still has to enter the
+// second factor. Returns false if there is no such user or the time to enter it has passed
+func mfaSessionUser(session *sessions.Session) (string, bool) {
+	username, ok := session.Values["mfaUser"].(string)
+	expires, _ := session.Values["mfaExpires"].(int64)
+	if !ok || time.Now().Unix() > expires {
+		return "", false
+	}
+	return username, true
+}
+
+// userMFAHandler renders and displays a form for entering the second factor after the password
+func (s *Server) userMFAHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Get the session
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The user has to enter the password first
+		username, ok := mfaSessionUser(session)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Username": username,
+		}
+
+		// Prepare data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// userMFASaveHandler checks the second factor and completes the login
+func (s *Server) userMFASaveHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The user has to enter the password first, and again when it took too long
+	username, ok := mfaSessionUser(session)
+	if !ok {
+		delete(session.Values, "mfaUser")
+		delete(session.Values, "mfaExpires")
+		session.AddFlash("login again, entering the code took too long")
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// Wrong codes count as failed logins, the password alone mustn't allow guessing the second factor
+	if s.loginLockedOut(w, r, session, username) {
+		return
+	}
+
+	// The account may have been disabled in the meantime
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil || user.Disabled {
+		delete(session.Values, "mfaUser")
+		delete(session.Values, "mfaExpires")
+		session.AddFlash("login failed")
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if user.TOTPEnabled {
+		if err := s.checkSecondFactor(user, r.FormValue("code")); err != nil {
+			if err != errInvalidCode && err != database.ErrTOTPCodeUsed {
+				log.Printf("db error: %v", err)
+			} else {
+				s.loginFailed(user.Username, s.remoteIP(r))
+			}
+			session.AddFlash(err.Error())
+			session.Save(r, w)
+			http.Redirect(w, r, "/login/mfa", http.StatusFound)
+			return
+		}
+	}
+	delete(session.Values, "mfaUser")
+	delete(session.Values, "mfaExpires")
+
+	s.completeLogin(w, r, session, user)
+}
+
+// setActiveUser logs the user in, by storing it in the session
+func setActiveUser(session *sessions.Session, user models.User) {
+	session.Values["activeUser"] = user.Username
+	session.Values["activeUserID"] = user.ID
+	session.Values["activeUserRole"] = user.Role
+}
+
+// clearActiveUser logs the active user out, by removing it from the session
+func clearActiveUser(session *sessions.Session) {
+	delete(session.Values, "activeUser")
+	delete(session.Values, "activeUserID")
+	delete(session.Values, "activeUserRole")
+}
+
+// userPasswordResetHandler renders and displays a form for choosing a new password after an admin forced a reset
+// It's only shown after logging in with the old password
+func (s *Server) userPasswordResetHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Get the session
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The user has to log in with the old password first
+		username, ok := session.Values["passwordResetUser"].(string)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Username": username,
+		}
+
+		// Prepare data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// userPasswordResetSaveHandler stores the new password of a user whose password was reset, and logs the user in
+func (s *Server) userPasswordResetSaveHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The user has to log in with the old password first
+	username, ok := session.Values["passwordResetUser"].(string)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// Check if password and confirmPassword match and the password is acceptable
+	password := r.FormValue("password")
+	if password != r.FormValue("confirmPassword") {
+		session.AddFlash("passwords don't match")
+		session.Save(r, w)
+		http.Redirect(w, r, "/login/password", http.StatusFound)
+		return
+	}
+	if err := models.ValidatePassword(password, username); err != nil {
+		session.AddFlash(err.Error())
+		session.Save(r, w)
+		http.Redirect(w, r, "/login/password", http.StatusFound)
+		return
+	}
+
+	// The account may have been disabled in the meantime
+	user, err := s.db.GetUserByUsername(username)
+	if err != nil || user.Disabled {
+		delete(session.Values, "passwordResetUser")
+		session.AddFlash("login failed")
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if user, err = s.db.UpdateUser(user, password); err != nil {
+		session.AddFlash(fmt.Sprintf("database error: %v", err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/login/password", http.StatusFound)
+		return
+	}
+	delete(session.Values, "passwordResetUser")
+
+	setActiveUser(session, user)
+	session.Save(r, w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// userLogoutHandler logs out the current user
+func (s *Server) userLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Delete the active user from the session
+	clearActiveUser(session)
+
+	// Save the session
+	session.Save(r, w)
+
+	// Redirect the user
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// passwordResetRequestHandler renders and displays a form for asking a password reset link
+func (s *Server) passwordResetRequestHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// After asking, the visitor is told to check the mailbox
+		data := map[string]interface{}{
+			"Sent": r.URL.Query().Get("sent") != "",
+		}
+
+		// Prepare data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// passwordResetRequestSaveHandler sends a password reset link, to the user with the username or the users with the
+// email address which was entered. Usernames can't contain an @, so that tells them apart
+func (s *Server) passwordResetRequestSaveHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	login := strings.TrimSpace(r.FormValue("login"))
+	if login == "" {
+		session.AddFlash("enter your username or email address")
+		session.Save(r, w)
+		http.Redirect(w, r, "/reset", http.StatusFound)
+		return
+	}
+
+	username, email := login, ""
+	if strings.Contains(login, "@") {
+		username, email = "", login
+	}
+	if err := s.requestPasswordReset(username, email); err != nil {
+		log.Printf("password reset error: %v", err)
+		session.AddFlash("couldn't send a password reset link, try again later")
+		session.Save(r, w)
+		http.Redirect(w, r, "/reset", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/reset?sent=1", http.StatusFound)
+}
+
+// passwordResetHandler renders and displays a form for choosing a new password with a password reset link
+func (s *Server) passwordResetHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args := mux.Vars(r)
+
+		// Get the session
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Links which can't be used anymore send the visitor to ask for a new one
+		user, _, err := s.passwordResetUser(args["token"])
+		if err != nil {
+			session.AddFlash(err.Error())
+			session.Save(r, w)
+			http.Redirect(w, r, "/reset", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Username":  user.Username,
+			"ResetLink": true,
+		}
+
+		// Prepare data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// passwordResetSaveHandler sets the new password with a password reset link, afterwards the user can log in with it
+func (s *Server) passwordResetSaveHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check if password and confirmPassword match
+	back := "/reset/" + url.PathEscape(args["token"])
+	password := r.FormValue("password")
+	if password != r.FormValue("confirmPassword") {
+		session.AddFlash("passwords don't match")
+		session.Save(r, w)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	if _, status, err := s.resetPassword(args["token"], password); err != nil {
+		// Only a rejected password can be fixed with the same link
+		if status != http.StatusBadRequest {
+			back = "/reset"
+		}
+		session.AddFlash(err.Error())
+		session.Save(r, w)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/login?reset=done", http.StatusFound)
+}
+
+// profileHandler renders and displays the forms for changing the name and the password of the logged in user
+func (s *Server) profileHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare the data which will be sent to the template
+		// After saving, the user is told what was saved
+		user := s.activeUser(r)
+		data := map[string]interface{}{
+			"User":  user,
+			"Saved": r.URL.Query().Get("saved"),
+			// A secret which isn't enabled yet is shown with a form to confirm it
+			"TOTPPending": user.TOTPSecret != "" && !user.TOTPEnabled,
+		}
+		if user.TOTPEnabled {
+			if data["RecoveryCodesLeft"], err = s.db.CountRecoveryCodes(user.ID); err != nil {
+				log.Printf("database error: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// profileSaveHandler changes the name and email address of the logged in user
+func (s *Server) profileSaveHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name, email := r.FormValue("name"), r.FormValue("email")
+	if _, _, err := s.updateProfile(s.activeUser(r), profileUpdate{Name: &name, Email: &email}); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/profile?saved=name", http.StatusFound)
+}
+
+// profilePasswordHandler changes the password of the logged in user, the current password is required
+func (s *Server) profilePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check if password and confirmPassword match
+	upd := profileUpdate{
+		CurrentPassword: r.FormValue("currentPassword"),
+		NewPassword:     r.FormValue("password"),
+	}
+	if upd.NewPassword == "" || upd.NewPassword != r.FormValue("confirmPassword") {
+		session.AddFlash("passwords don't match")
+		session.Save(r, w)
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	if _, _, err := s.updateProfile(s.activeUser(r), upd); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/profile?saved=password", http.StatusFound)
+}
+
+// profileVerificationHandler sends a new link to verify the email address of the logged in user
+func (s *Server) profileVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, _, err := s.resendVerification(s.activeUser(r).Username); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Save(r, w)
+
+		// Redirect
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/profile?saved=verification", http.StatusFound)
+}
 
-	// Get the user from the database
-	user, err := s.db.GetUserByUsername(username)
+// profileTOTPHandler starts enabling two-factor authentication for the logged in user, the current password is
+// required. The profile shows the new secret afterwards, with a form to confirm it with a code
+func (s *Server) profileTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
 	if err != nil {
-		// Couldn't get the user from the database
-		log.Printf("db error: %v", err)
-		session.AddFlash("login failed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, _, err := s.startTOTPEnrollment(s.activeUser(r), r.FormValue("currentPassword")); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(err.Error())
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/profile#totp", http.StatusFound)
+}
+
+// profileTOTPQRCodeHandler serves the QR code of the secret the logged in user is enabling, as a PNG image
+func (s *Server) profileTOTPQRCodeHandler(w http.ResponseWriter, r *http.Request) {
+	key, status, err := pendingTOTPKey(s.activeUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	qr, err := totpQRCode(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The image contains the secret, it mustn't be kept in any cache
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(qr)
+}
+
+// profileRecoveryCodesHandler renders and displays new recovery codes, after confirming a new secret or after
+// asking for new codes. The codes are only shown on this page, so it isn't reached with a redirect
+func (s *Server) profileRecoveryCodesHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Parse the HTML form
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Get the session
+		session, err := s.store.Get(r, SessionName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Both require the current password, confirming a new secret requires a code as well
+		user := s.activeUser(r)
+		var codes []string
+		if user.TOTPEnabled {
+			codes, _, err = s.regenerateRecoveryCodes(user, r.FormValue("currentPassword"))
+		} else {
+			codes, _, err = s.confirmTOTPEnrollment(user, r.FormValue("currentPassword"), r.FormValue("code"))
+		}
+		if err != nil {
+			// Add a flash message to the session. Then save the session.
+			session.AddFlash(err.Error())
+			session.Save(r, w)
+
+			// Redirect
+			http.Redirect(w, r, "/profile#totp", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"RecoveryCodes": codes,
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// The codes mustn't be kept in any cache either
+		w.Header().Set("Cache-Control", "no-store")
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// profileTOTPDisableHandler turns off two-factor authentication for the logged in user, or stops enabling it
+// The current password is required
+func (s *Server) profileTOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := s.disableTOTP(s.activeUser(r), r.FormValue("currentPassword")); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(err.Error())
 		session.Save(r, w)
 
 		// Redirect
-		http.Redirect(w, r, "/login", http.StatusFound)
+		http.Redirect(w, r, "/profile#totp", http.StatusFound)
 		return
 	}
 
-	// Check if the password matches
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		// Password doesn't match
-		session.AddFlash("login failed")
+	http.Redirect(w, r, "/profile?saved=totp", http.StatusFound)
+}
+
+// verifyEmailHandler verifies an email address with the link from the verification email
+// The link works without logging in, logged in users are sent back to their profile
+func (s *Server) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	loggedIn := s.activeUser(r).ID != 0
+	if _, _, err := s.verifyEmail(args["token"]); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(err.Error())
 		session.Save(r, w)
 
 		// Redirect
-		http.Redirect(w, r, "/login", http.StatusFound)
+		if loggedIn {
+			http.Redirect(w, r, "/profile", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/login", http.StatusFound)
+		}
 		return
 	}
 
-	session.Values["activeUser"] = user.Username
-	session.Values["activeUserID"] = user.ID
-	session.Save(r, w)
-	http.Redirect(w, r, "/", http.StatusFound)
+	if loggedIn {
+		http.Redirect(w, r, "/profile?saved=verified", http.StatusFound)
+	} else {
+		http.Redirect(w, r, "/login?verified=1", http.StatusFound)
+	}
 }
 
-// userLogoutHandler logs out the current user
-func (s *Server) userLogoutHandler(w http.ResponseWriter, r *http.Request) {
+// usersAdminHandler renders and displays the users with forms for changing them, only for admins
+func (s *Server) usersAdminHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		users, err := s.db.GetUsers()
+		if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare the data which will be sent to the template
+		data := map[string]interface{}{
+			"Users": users,
+			"Roles": models.Roles,
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// userAdminSaveHandler changes the name, role and account state of a user, only for admins
+func (s *Server) userAdminSaveHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Parse the HTML form
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Get the session
 	session, err := s.store.Get(r, SessionName)
 	if err != nil {
@@ -417,13 +2289,123 @@ func (s *Server) userLogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete the active user from the session
-	delete(session.Values, "activeUser")
-	delete(session.Values, "activeUserID")
+	// The form always sends all fields, unchecked checkboxes are missing
+	name, role := r.FormValue("name"), r.FormValue("role")
+	disabled, passwordReset := r.FormValue("disabled") != "", r.FormValue("password_reset") != ""
+	emailVerified := r.FormValue("email_verified") != ""
+	upd := userUpdate{Name: &name, EmailVerified: &emailVerified, Role: &role, Disabled: &disabled, PasswordReset: &passwordReset}
 
-	// Save the session
-	session.Save(r, w)
+	if _, _, err := s.updateUser(s.activeUser(r), args["username"], upd); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("couldn't change %s: %v", args["username"], err))
+		session.Save(r, w)
+	}
 
-	// Redirect the user
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, "/admin/users#user-"+url.PathEscape(args["username"]), http.StatusFound)
+}
+
+// userAdminVerificationHandler sends a new email verification link to a user, only for admins
+func (s *Server) userAdminVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, _, err := s.resendVerification(args["username"]); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("couldn't send a verification link to %s: %v", args["username"], err))
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/admin/users#user-"+url.PathEscape(args["username"]), http.StatusFound)
+}
+
+// userAdminDeleteHandler deletes a user, only for admins
+func (s *Server) userAdminDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, _, err := s.deleteUser(s.activeUser(r), args["username"]); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("couldn't delete %s: %v", args["username"], err))
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// locksAdminHandler renders and displays the usernames and IP addresses with recent failed logins, only for admins
+func (s *Server) locksAdminHandler(files ...string) http.HandlerFunc {
+	var (
+		init sync.Once
+		tpl  *template.Template
+		err  error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute initialization transactions only once
+		init.Do(func() {
+			tpl, err = template.New("").ParseFiles(files...)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		throttles, err := s.db.GetLoginThrottles(now.Add(-ThrottleWindow))
+		if err != nil {
+			log.Printf("database error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare the data which will be sent to the template
+		data := map[string]interface{}{
+			"Throttles": throttles,
+			"Now":       now,
+			"Window":    ThrottleWindow,
+		}
+
+		// Prepare the data
+		s.PrepareData(w, r, data)
+
+		// Execute the template (https://golang.org/pkg/text/template/#Template.Execute)
+		if err := tpl.ExecuteTemplate(w, "main", data); err != nil {
+			// Parsing the template went wrong, let's log and return the error
+			log.Printf("template execution error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// lockAdminClearHandler forgets the failed logins of a username or an IP address and lifts its lockout, only for admins
+func (s *Server) lockAdminClearHandler(w http.ResponseWriter, r *http.Request) {
+	args := mux.Vars(r)
+
+	// Get the session
+	session, err := s.store.Get(r, SessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := s.clearLoginThrottle(args["kind"], args["value"]); err != nil {
+		// Add a flash message to the session. Then save the session.
+		session.AddFlash(fmt.Sprintf("couldn't clear %s %s: %v", args["kind"], args["value"], err))
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/admin/locks", http.StatusFound)
 }